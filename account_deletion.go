@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+// accountDeletionGracePeriod is how long a user has to change their mind
+// after asking for their account to be deleted.
+const accountDeletionGracePeriod = 14 * 24 * time.Hour
+
+// accountDeletionConfirmationTTL is how long the link confirming a deletion
+// requested without a password works.
+const accountDeletionConfirmationTTL = time.Hour
+
+// scheduleAccountDeletion schedules a user's account to be deleted once the
+// grace period is over, signs them out everywhere and emails them a link to
+// undo it. It returns when the account will be deleted.
+func (cfg *apiConfig) scheduleAccountDeletion(ctx context.Context, user database.User) (time.Time, error) {
+	deleteAfter := time.Now().UTC().Add(accountDeletionGracePeriod)
+	cancelToken, err := cfg.createUserToken(ctx, user.ID, database.UserTokenPurposeCancelDeletion, accountDeletionGracePeriod)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't create cancellation token: %w", err)
+	}
+	err = cfg.db.ScheduleUserDeletion(ctx, user.ID, deleteAfter)
+	if err != nil {
+		return time.Time{}, err
+	}
+	slog.InfoContext(ctx, "Scheduled account deletion", "user_id", user.ID, "delete_after", deleteAfter)
+
+	err = cfg.sendAccountDeletionEmail(ctx, user, cancelToken, deleteAfter)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't send account deletion email", "user_id", user.ID, "error", err)
+	}
+	return deleteAfter, nil
+}
+
+func (cfg *apiConfig) sendAccountDeletionConfirmationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.createUserToken(ctx, user.ID, database.UserTokenPurposeConfirmDeletion, accountDeletionConfirmationTTL)
+	if err != nil {
+		return fmt.Errorf("couldn't create confirmation token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/app/?confirm_deletion_token=%s", cfg.publicBaseURL, token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm deleting your Tubely account",
+		Body: fmt.Sprintf(
+			"Someone asked to delete this Tubely account and all of its videos.\n\nConfirm it here:\n\n%s\n\nThe link expires in %s. If this wasn't you, you can ignore this email.\n",
+			link, accountDeletionConfirmationTTL,
+		),
+	})
+}
+
+func (cfg *apiConfig) sendAccountDeletionEmail(ctx context.Context, user database.User, cancelToken string, deleteAfter time.Time) error {
+	link := fmt.Sprintf("%s/app/?cancel_deletion_token=%s", cfg.publicBaseURL, cancelToken)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your Tubely account will be deleted",
+		Body: fmt.Sprintf(
+			"Your Tubely account and all of its videos will be deleted on %s.\n\nIf you change your mind before then, keep your account here:\n\n%s\n\nIf this wasn't you, open the link and change your password.\n",
+			deleteAfter.Format("2 January 2006 at 15:04 MST"), link,
+		),
+	})
+}
+
+// deleteDueAccounts deletes the accounts whose grace period is over.
+func (cfg *apiConfig) deleteDueAccounts(ctx context.Context, now time.Time) {
+	userIDs, err := cfg.db.GetUsersDueForDeletion(ctx, now)
+	if err != nil {
+		slog.Error("Couldn't get accounts due for deletion", "error", err)
+		return
+	}
+
+	for _, userID := range userIDs {
+		// whatever was deleted stays deleted, so a failed deletion carries on
+		// from where it stopped the next time round
+		if err := cfg.deleteAccount(ctx, userID); err != nil {
+			slog.Error("Couldn't delete account", "user_id", userID, "error", err)
+			continue
+		}
+		slog.Info("Deleted account", "user_id", userID)
+	}
+}
+
+// deleteAccount deletes a user's exports, thumbnails and videos along with
+// their files in storage, then everything else stored about the user.
+func (cfg *apiConfig) deleteAccount(ctx context.Context, userID uuid.UUID) error {
+	// an export claimed after the scan below would be uploaded after the
+	// user is gone, so stop the waiting ones from being claimed first. Any
+	// claimed before this show up as running.
+	err := cfg.db.FailPendingUserExports(ctx, userID, "Account deleted")
+	if err != nil {
+		return fmt.Errorf("couldn't cancel pending exports: %w", err)
+	}
+	exports, err := cfg.db.GetUserExports(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get exports: %w", err)
+	}
+	for _, export := range exports {
+		// the archive would be uploaded after the user is gone, so wait for
+		// it to finish and delete it then
+		if export.Status == database.ExportStatusRunning {
+			return fmt.Errorf("export %s is being built", export.ID)
+		}
+		if export.Status != database.ExportStatusReady || export.Bucket == nil || export.Key == nil {
+			continue
+		}
+		err := cfg.deleteStorageObject(ctx, database.StorageObject{Bucket: *export.Bucket, Key: *export.Key})
+		if err != nil {
+			return fmt.Errorf("couldn't delete export %s: %w", export.ID, err)
+		}
+	}
+
+	videos, err := cfg.db.GetVideos(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("couldn't get videos: %w", err)
+	}
+	for _, video := range videos {
+		if err := cfg.deleteVideo(ctx, video); err != nil {
+			return fmt.Errorf("couldn't delete video %s: %w", video.ID, err)
+		}
+	}
+
+	return cfg.db.DeleteUser(ctx, userID)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// accountStatusMiddleware rejects access tokens of disabled users and users
+// whose account is scheduled for deletion, and ones issued before the user's
+// tokens were revoked. Access tokens are long-lived JWTs, so without this
+// they would keep working until they expire. Requests without a valid access
+// token are left to the handlers. The user of a valid token is recorded for
+// the access log.
+func (cfg *apiConfig) accountStatusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		claims, err := auth.ValidateJWTClaims(token, cfg.jwtKeys)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cfg.respondIfTokenBlocked(r.Context(), w, claims) {
+			return
+		}
+		setRequestUser(r.Context(), claims.UserID)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// respondIfTokenBlocked responds with an error and returns true if the user
+// of a token can't use the account any more, or the token was issued before
+// the user's tokens were revoked.
+func (cfg *apiConfig) respondIfTokenBlocked(ctx context.Context, w http.ResponseWriter, claims auth.AccessClaims) bool {
+	access, err := cfg.db.GetUserAccess(ctx, claims.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check account status", err)
+		return true
+	}
+	if message, blocked := accountBlocked(access); blocked {
+		respondWithError(w, http.StatusForbidden, message, nil)
+		return true
+	}
+	if access.TokensRevokedAt != nil && !claims.IssuedAt.After(*access.TokensRevokedAt) {
+		respondWithError(w, http.StatusUnauthorized, "Token has been revoked, sign in again", nil)
+		return true
+	}
+	return false
+}
+
+// respondIfDisabled responds with 403 and returns true if the account has
+// been disabled or is scheduled for deletion.
+func (cfg *apiConfig) respondIfDisabled(ctx context.Context, w http.ResponseWriter, userID uuid.UUID) bool {
+	access, err := cfg.db.GetUserAccess(ctx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check account status", err)
+		return true
+	}
+	message, blocked := accountBlocked(access)
+	if !blocked {
+		return false
+	}
+	respondWithError(w, http.StatusForbidden, message, nil)
+	return true
+}
+
+// accountBlocked reports whether an account can't be used and why.
+func accountBlocked(access database.UserAccess) (string, bool) {
+	switch {
+	case access.DisabledAt != nil:
+		return "Account disabled", true
+	case access.DeleteAfter != nil:
+		return "Account is scheduled for deletion, use the link in the email to keep it", true
+	}
+	return "", false
+}
@@ -1,4 +1,9 @@
 document.addEventListener('DOMContentLoaded', async () => {
+  if (await handleEmailLinks()) {
+    return;
+  }
+  await finishOIDCLogin();
+
   const token = localStorage.getItem('token');
 
   if (token) {
@@ -21,9 +26,165 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
   await login();
 });
 
+// handleEmailLinks finishes the flows started by links in emails, which open
+// the app with a token in the query string. It returns true if the page is
+// showing one of those flows instead of the usual sections.
+async function handleEmailLinks() {
+  const params = new URLSearchParams(window.location.search);
+  const verifyEmailToken = params.get('verify_email_token');
+  const passwordResetToken = params.get('password_reset_token');
+  const cancelDeletionToken = params.get('cancel_deletion_token');
+  const confirmDeletionToken = params.get('confirm_deletion_token');
+  if (!verifyEmailToken && !passwordResetToken && !cancelDeletionToken && !confirmDeletionToken) {
+    return false;
+  }
+  // the tokens shouldn't stay in the address bar or the history
+  history.replaceState(null, '', window.location.pathname);
+
+  if (verifyEmailToken) {
+    await verifyEmail(verifyEmailToken);
+    return false;
+  }
+  if (cancelDeletionToken) {
+    await cancelAccountDeletion(cancelDeletionToken);
+    return false;
+  }
+  if (confirmDeletionToken) {
+    await confirmAccountDeletion(confirmDeletionToken);
+    return false;
+  }
+
+  document.getElementById('auth-section').style.display = 'none';
+  document.getElementById('video-section').style.display = 'none';
+  document.getElementById('password-reset-section').style.display = 'block';
+  document.getElementById('password-reset-form').addEventListener('submit', async (event) => {
+    event.preventDefault();
+    await resetPassword(passwordResetToken);
+  });
+  return true;
+}
+
+async function verifyEmail(token) {
+  try {
+    const res = await fetch('/api/users/verify', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to verify email: ${data.error}`);
+    }
+    alert('Your email address is verified.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function cancelAccountDeletion(token) {
+  try {
+    const res = await fetch('/api/users/deletion/cancel', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to keep your account: ${data.error}`);
+    }
+    // scheduling the deletion signed the account out everywhere
+    localStorage.removeItem('token');
+    alert('Your account will not be deleted, log in to keep using it.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function confirmAccountDeletion(token) {
+  if (!confirm('Delete your account and all of its videos?')) {
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/users/deletion/confirm', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token }),
+    });
+    const data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to delete your account: ${data.error}`);
+    }
+    // scheduling the deletion signed the account out everywhere
+    localStorage.removeItem('token');
+    alert(`Your account will be deleted on ${new Date(data.delete_after).toLocaleString()}. Use the link in the email to keep it.`);
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function forgotPassword() {
+  const email = document.getElementById('email').value;
+  if (!email) {
+    alert('Enter your email address first.');
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/password/forgot', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ email }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to request a password reset: ${data.error}`);
+    }
+    alert('If that email has an account, a link to reset the password is on its way.');
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
+async function resetPassword(token) {
+  const password = document.getElementById('new-password').value;
+  if (password !== document.getElementById('new-password-confirm').value) {
+    alert('The passwords do not match.');
+    return;
+  }
+
+  try {
+    const res = await fetch('/api/password/reset', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token, password }),
+    });
+    if (!res.ok) {
+      const data = await res.json();
+      throw new Error(`Failed to reset password: ${data.error}`);
+    }
+    alert('Your password has been reset, you can log in with it now.');
+    document.getElementById('password-reset-section').style.display = 'none';
+    logout();
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 async function createVideoDraft() {
   const title = document.getElementById('video-title').value;
   const description = document.getElementById('video-description').value;
+  const visibility = document.getElementById('video-visibility').value;
 
   try {
     const res = await fetch('/api/videos', {
@@ -32,7 +193,7 @@ async function createVideoDraft() {
         'Content-Type': 'application/json',
         Authorization: `Bearer ${localStorage.getItem('token')}`,
       },
-      body: JSON.stringify({ title, description }),
+      body: JSON.stringify({ title, description, visibility }),
     });
     const data = await res.json();
     if (!res.ok) {
@@ -49,6 +210,65 @@ async function createVideoDraft() {
   }
 }
 
+async function completeMFALogin(mfaToken) {
+  const code = prompt('Enter the code from your authenticator app, or a recovery code');
+  if (!code) {
+    throw new Error('Two-factor code is required');
+  }
+  const isRecoveryCode = code.replace(/\s/g, '').length > 6;
+
+  const res = await fetch('/api/login/mfa', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json',
+    },
+    body: JSON.stringify(
+      isRecoveryCode
+        ? { mfa_token: mfaToken, recovery_code: code }
+        : { mfa_token: mfaToken, code }
+    ),
+  });
+  const data = await res.json();
+  if (!res.ok) {
+    throw new Error(`Failed to login: ${data.error}`);
+  }
+  return data;
+}
+
+// finishOIDCLogin exchanges the code the app is opened with after signing in
+// through the identity provider for a session.
+async function finishOIDCLogin() {
+  const params = new URLSearchParams(window.location.search);
+  const code = params.get('oidc_code');
+  if (!code) {
+    return;
+  }
+  history.replaceState(null, '', window.location.pathname);
+
+  try {
+    const res = await fetch('/api/oidc/exchange', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ code }),
+    });
+    let data = await res.json();
+    if (!res.ok) {
+      throw new Error(`Failed to login: ${data.error}`);
+    }
+
+    if (data.mfa_required) {
+      data = await completeMFALogin(data.mfa_token);
+    }
+    if (data.token) {
+      localStorage.setItem('token', data.token);
+    }
+  } catch (error) {
+    alert(`Error: ${error.message}`);
+  }
+}
+
 async function login() {
   const email = document.getElementById('email').value;
   const password = document.getElementById('password').value;
@@ -61,11 +281,15 @@ async function login() {
       },
       body: JSON.stringify({ email, password }),
     });
-    const data = await res.json();
+    let data = await res.json();
     if (!res.ok) {
       throw new Error(`Failed to login: ${data.error}`);
     }
 
+    if (data.mfa_required) {
+      data = await completeMFALogin(data.mfa_token);
+    }
+
     if (data.token) {
       localStorage.setItem('token', data.token);
       document.getElementById('auth-section').style.display = 'none';
@@ -161,8 +385,10 @@ async function uploadVideoFile(videoID) {
 
   uploadBtnSelector = 'upload-video-btn';
   setUploadButtonState(true, uploadBtnSelector);
+  let progress = null;
 
   try {
+    progress = await watchUploadProgress(videoID, uploadBtnSelector);
     const res = await fetch(`/api/video_upload/${videoID}`, {
       method: 'POST',
       headers: {
@@ -181,9 +407,50 @@ async function uploadVideoFile(videoID) {
     alert(`Error: ${error.message}`);
   }
 
+  if (progress) progress.close();
   setUploadButtonState(false, uploadBtnSelector);
 }
 
+const uploadStageLabels = {
+  receiving: 'Uploading',
+  probing: 'Inspecting',
+  processing: 'Processing',
+  storing: 'Saving',
+  done: 'Finishing',
+  failed: 'Failed',
+};
+
+// mediaToken gets a short-lived token for the video, for <video> and
+// EventSource which can't send the Authorization header. The access token
+// itself never goes in a URL.
+async function mediaToken(videoID) {
+  const res = await fetch(`/api/videos/${videoID}/media_token`, {
+    method: 'POST',
+    headers: {
+      Authorization: `Bearer ${localStorage.getItem('token')}`,
+    },
+  });
+  if (!res.ok) {
+    throw new Error('Failed to get media token.');
+  }
+  const data = await res.json();
+  return encodeURIComponent(data.token);
+}
+
+// watchUploadProgress shows the server's progress events for an upload on
+// the upload button until the returned EventSource is closed.
+async function watchUploadProgress(videoID, selector) {
+  const token = await mediaToken(videoID);
+  const source = new EventSource(`/api/videos/${videoID}/progress?token=${token}`);
+  source.addEventListener('progress', (event) => {
+    const update = JSON.parse(event.data);
+    const label = uploadStageLabels[update.stage] || update.stage;
+    const percent = update.percent >= 0 ? ` ${Math.floor(update.percent)}%` : '';
+    document.getElementById(selector).textContent = `${label}${percent}...`;
+  });
+  return source;
+}
+
 const videoStateHandler = createVideoStateHandler();
 
 async function getVideos() {
@@ -270,8 +537,14 @@ function viewVideo(video) {
       videoPlayer.style.display = 'none';
     } else {
       videoPlayer.style.display = 'block';
-      videoPlayer.src = video.video_url;
-      videoPlayer.load();
+      // play through the server's streaming proxy rather than the
+      // presigned storage URL
+      mediaToken(video.id)
+        .then((token) => {
+          videoPlayer.src = `/api/videos/${video.id}/stream?token=${token}`;
+          videoPlayer.load();
+        })
+        .catch((error) => alert(`Error: ${error.message}`));
     }
   }
 }
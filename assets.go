@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
@@ -15,16 +13,10 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	return nil
 }
 
-func getAssetPath(mediaType string) string {
-	base := make([]byte, 32)
-	_, err := rand.Read(base)
-	if err != nil {
-		panic("failed to generate random bytes")
-	}
-	id := base64.RawURLEncoding.EncodeToString(base)
-
-	ext := mediaTypeToExt(mediaType)
-	return fmt.Sprintf("%s%s", id, ext)
+// getContentAddressedPath names a stored file after the SHA-256 of its
+// content, so uploading the same file again maps to the same object.
+func getContentAddressedPath(contentHash, mediaType string) string {
+	return contentHash + mediaTypeToExt(mediaType)
 }
 
 func (cfg apiConfig) getObjectURL(key string) string {
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// A backup is a gzipped tar of a consistent copy of the database, the files
+// in the assets directory and a manifest. Video files stay in the bucket,
+// which is expected to be versioned or replicated; the manifest lists the
+// ones the database refers to so a restore can check they're all there.
+const (
+	backupFormatVersion  = 1
+	backupManifestName   = "manifest.json"
+	backupDatabaseName   = "tubely.db"
+	backupAssetsDir      = "assets"
+	backupTimeFormat     = "20060102T150405Z"
+	restoreTempExtension = ".restoring"
+)
+
+type backupManifest struct {
+	FormatVersion  int            `json:"format_version"`
+	CreatedAt      time.Time      `json:"created_at"`
+	DatabaseSHA256 string         `json:"database_sha256"`
+	Objects        []storedObject `json:"objects"`
+	Assets         []backupAsset  `json:"assets"`
+}
+
+type backupAsset struct {
+	// Path is relative to the assets directory, with forward slashes
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+func cmdBackup(fs *flag.FlagSet) runFunc {
+	output := fs.String("o", "", "file to write the backup to (default tubely-backup-<time>.tar.gz)")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		backupPath := *output
+		if backupPath == "" {
+			backupPath = fmt.Sprintf("tubely-backup-%s.tar.gz", time.Now().UTC().Format(backupTimeFormat))
+		}
+
+		tmpDir, err := os.MkdirTemp("", "tubely-backup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+
+		snapshotPath := filepath.Join(tmpDir, backupDatabaseName)
+		err = cfg.db.Backup(ctx, snapshotPath)
+		if err != nil {
+			return fmt.Errorf("couldn't copy database: %w", err)
+		}
+
+		// the manifest comes from the copy so it matches it exactly, even if
+		// videos were uploaded since
+		objects, err := snapshotObjects(ctx, snapshotPath)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := writeBackup(backupPath, snapshotPath, cfg.assetsRoot, objects)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Backed up the database, %d assets and a manifest of %d stored objects to %s\n", len(manifest.Assets), len(manifest.Objects), backupPath)
+		return nil
+	})
+}
+
+// snapshotObjects lists the stored objects a copy of the database refers to.
+func snapshotObjects(ctx context.Context, snapshotPath string) ([]storedObject, error) {
+	snapshot, err := database.NewClient(snapshotPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open database copy: %w", err)
+	}
+	defer snapshot.Close()
+
+	versions, err := snapshot.GetAllVideoVersions(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get video versions: %w", err)
+	}
+
+	seen := map[string]bool{}
+	objects := []storedObject{}
+	for _, version := range versions {
+		if seen[version.StorageURL()] {
+			continue
+		}
+		seen[version.StorageURL()] = true
+		objects = append(objects, storedObjectOf(version))
+	}
+	return objects, nil
+}
+
+// writeBackup writes the database copy and the assets to a new archive at
+// backupPath, hashing them on the way, and adds the manifest last.
+func writeBackup(backupPath, snapshotPath, assetsRoot string, objects []storedObject) (manifest backupManifest, err error) {
+	manifest = backupManifest{
+		FormatVersion: backupFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Objects:       objects,
+		Assets:        []backupAsset{},
+	}
+
+	file, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return manifest, err
+	}
+	// only remove a partial archive this created, never a file that was
+	// already there
+	defer func() {
+		file.Close()
+		if err != nil {
+			os.Remove(backupPath)
+		}
+	}()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	_, manifest.DatabaseSHA256, err = addFileToTar(tw, backupDatabaseName, snapshotPath)
+	if err != nil {
+		return manifest, fmt.Errorf("couldn't add database: %w", err)
+	}
+
+	err = filepath.WalkDir(assetsRoot, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(assetsRoot, filePath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		size, sum, err := addFileToTar(tw, path.Join(backupAssetsDir, rel), filePath)
+		if err != nil {
+			return err
+		}
+		manifest.Assets = append(manifest.Assets, backupAsset{Path: rel, SizeBytes: size, SHA256: sum})
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return manifest, fmt.Errorf("couldn't add assets: %w", err)
+	}
+
+	dat, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0600,
+		Size:    int64(len(dat)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return manifest, err
+	}
+	if _, err := tw.Write(dat); err != nil {
+		return manifest, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return manifest, err
+	}
+	if err := gz.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, file.Close()
+}
+
+// addFileToTar adds a file as name and returns its size and SHA-256. The
+// size is fixed when it starts, so a file still being written is cut off
+// there rather than failing the backup.
+func addFileToTar(tw *tar.Writer, name, filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	hasher := sha256.New()
+	_, err = io.CopyN(io.MultiWriter(tw, hasher), file, info.Size())
+	if err != nil {
+		return 0, "", err
+	}
+	return info.Size(), hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func cmdRestore(fs *flag.FlagSet) runFunc {
+	check := fs.Bool("check", false, "only check the backup against the bucket, don't restore anything")
+	force := fs.Bool("force", false, "replace an existing database")
+	allowMissing := fs.Bool("allow-missing", false, "restore even if stored objects are missing or damaged")
+	return func(ctx context.Context, conf config.Config, args []string) error {
+		if len(args) != 1 {
+			return errors.New("expected a backup file")
+		}
+		backupPath := args[0]
+
+		manifest, err := readBackupManifest(backupPath)
+		if err != nil {
+			return err
+		}
+		if manifest.FormatVersion != backupFormatVersion {
+			return fmt.Errorf("unsupported backup format version %d", manifest.FormatVersion)
+		}
+
+		s3Client, err := newS3Client(conf)
+		if err != nil {
+			return err
+		}
+		// the restored database is pointed at the configured bucket, so
+		// that's where the objects have to be, whichever bucket they were
+		// backed up from
+		problems := 0
+		for _, object := range manifest.Objects {
+			object.Bucket = conf.S3.Bucket
+			if err := verifyStoredObject(ctx, s3Client, object); err != nil {
+				problems++
+				fmt.Printf("%s/%s: %v\n", object.Bucket, object.Key, err)
+			}
+		}
+		fmt.Printf("Checked %d stored objects from the backup of %s, %d problems\n", len(manifest.Objects), manifest.CreatedAt.Format(time.RFC3339), problems)
+
+		if *check {
+			if problems > 0 {
+				return fmt.Errorf("%d stored objects are missing or damaged", problems)
+			}
+			return nil
+		}
+		if problems > 0 && !*allowMissing {
+			return fmt.Errorf("%d stored objects are missing or damaged, restore them to the bucket first or use -allow-missing", problems)
+		}
+		if _, err := os.Stat(conf.DBPath); err == nil && !*force {
+			return fmt.Errorf("%s already exists, stop the server and use -force to replace it", conf.DBPath)
+		}
+
+		err = extractBackup(ctx, backupPath, manifest, conf.DBPath, conf.AssetsRoot, conf.S3.Bucket)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored the database to %s and %d assets to %s\n", conf.DBPath, len(manifest.Assets), conf.AssetsRoot)
+		return nil
+	}
+}
+
+// openBackup calls fn with each entry of a backup archive until it returns
+// an error.
+func openBackup(backupPath string, fn func(header *tar.Header, r io.Reader) error) error {
+	file, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't read backup: %w", err)
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readBackupManifest(backupPath string) (backupManifest, error) {
+	var manifest backupManifest
+	found := false
+	err := openBackup(backupPath, func(header *tar.Header, r io.Reader) error {
+		if header.Name != backupManifestName {
+			return nil
+		}
+		found = true
+		return json.NewDecoder(r).Decode(&manifest)
+	})
+	if err != nil {
+		return backupManifest{}, err
+	}
+	if !found {
+		return backupManifest{}, errors.New("backup has no manifest")
+	}
+	return manifest, nil
+}
+
+// extractBackup restores the database and assets, checking each against the
+// manifest. Everything is extracted beside where it goes and only moved into
+// place once all of it has checked out, so a damaged backup leaves the
+// current files alone. The restored database is pointed at bucket.
+func extractBackup(ctx context.Context, backupPath string, manifest backupManifest, dbPath, assetsRoot, bucket string) error {
+	assets := make(map[string]backupAsset, len(manifest.Assets))
+	for _, asset := range manifest.Assets {
+		assets[asset.Path] = asset
+	}
+
+	tmpDBPath := dbPath + restoreTempExtension
+	defer os.Remove(tmpDBPath)
+	restoredDB := false
+
+	// inside the assets directory so the renames stay on one filesystem
+	if err := os.MkdirAll(assetsRoot, 0755); err != nil {
+		return err
+	}
+	tmpAssetsRoot, err := os.MkdirTemp(assetsRoot, restoreTempExtension+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpAssetsRoot)
+	extracted := map[string]bool{}
+
+	err = openBackup(backupPath, func(header *tar.Header, r io.Reader) error {
+		switch {
+		case header.Name == backupDatabaseName:
+			restoredDB = true
+			return extractFile(r, tmpDBPath, manifest.DatabaseSHA256)
+		case strings.HasPrefix(header.Name, backupAssetsDir+"/"):
+			rel := strings.TrimPrefix(header.Name, backupAssetsDir+"/")
+			asset, ok := assets[rel]
+			if !ok || !filepath.IsLocal(rel) || extracted[rel] {
+				return fmt.Errorf("unexpected file %s in backup", header.Name)
+			}
+			extracted[rel] = true
+			target := filepath.Join(tmpAssetsRoot, filepath.FromSlash(rel))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			return extractFile(r, target, asset.SHA256)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !restoredDB {
+		return errors.New("backup has no database")
+	}
+	for _, asset := range manifest.Assets {
+		if !extracted[asset.Path] {
+			return fmt.Errorf("backup is missing %s", path.Join(backupAssetsDir, asset.Path))
+		}
+	}
+	if err := moveBackupBucket(ctx, tmpDBPath, manifest, bucket); err != nil {
+		return err
+	}
+
+	for _, asset := range manifest.Assets {
+		rel := filepath.FromSlash(asset.Path)
+		target := filepath.Join(assetsRoot, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(tmpAssetsRoot, rel), target); err != nil {
+			return err
+		}
+	}
+
+	// leftover journal files belong to the database being replaced
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmpDBPath, dbPath)
+}
+
+// moveBackupBucket points a restored database that was backed up against a
+// different bucket at bucket.
+func moveBackupBucket(ctx context.Context, dbPath string, manifest backupManifest, bucket string) error {
+	from := map[string]bool{}
+	for _, object := range manifest.Objects {
+		if object.Bucket != bucket {
+			from[object.Bucket] = true
+		}
+	}
+	if len(from) == 0 {
+		return nil
+	}
+
+	db, err := database.NewClient(dbPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open restored database: %w", err)
+	}
+	defer db.Close()
+	for b := range from {
+		if err := db.MoveStorageBucket(ctx, b, bucket); err != nil {
+			return fmt.Errorf("couldn't move restored files from bucket %s to %s: %w", b, bucket, err)
+		}
+	}
+	return db.Close()
+}
+
+// extractFile writes r to filePath and checks it has the expected SHA-256.
+func extractFile(r io.Reader, filePath, wantSHA256 string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hasher), r); err != nil {
+		return fmt.Errorf("couldn't extract %s: %w", filePath, err)
+	}
+	if got := hex.EncodeToString(hasher.Sum(nil)); got != wantSHA256 {
+		return fmt.Errorf("%s is damaged: SHA-256 is %s, expected %s", filePath, got, wantSHA256)
+	}
+	return file.Close()
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+)
+
+const (
+	contentMD5Header     = "Content-MD5"
+	checksumMD5Header    = "X-Checksum-MD5"
+	checksumSHA256Header = "X-Checksum-SHA256"
+)
+
+// uploadChecksum is a digest the client sent for an uploaded file, and the
+// hash that computes it.
+type uploadChecksum struct {
+	header string
+	want   []byte
+	hash   hash.Hash
+}
+
+func (c uploadChecksum) verify() error {
+	if got := c.hash.Sum(nil); !bytes.Equal(got, c.want) {
+		return fmt.Errorf("%s mismatch: client sent %x, received file has %x", c.header, c.want, got)
+	}
+	return nil
+}
+
+// parseUploadChecksums reads the optional digests of an uploaded file: an
+// MD5 (base64, as in RFC 1864) in Content-MD5 or X-Checksum-MD5, and a SHA-256
+// (hex or base64) in X-Checksum-SHA256. They're taken from the multipart file
+// part's headers, or failing that from the X- headers of the request. The
+// request's own Content-MD5 is the digest of the whole multipart body, not
+// the file, so it's not used.
+func parseUploadChecksums(part, request http.Header) ([]uploadChecksum, error) {
+	get := func(name string, headers ...http.Header) string {
+		for _, h := range headers {
+			if v := h.Get(name); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	checksums := []uploadChecksum{}
+	md5Header, md5Value := contentMD5Header, get(contentMD5Header, part)
+	if md5Value == "" {
+		md5Header, md5Value = checksumMD5Header, get(checksumMD5Header, part, request)
+	}
+	if md5Value != "" {
+		want, err := base64.StdEncoding.DecodeString(md5Value)
+		if err != nil || len(want) != md5.Size {
+			return nil, fmt.Errorf("%s must be a base64 encoded MD5 digest", md5Header)
+		}
+		checksums = append(checksums, uploadChecksum{header: md5Header, want: want, hash: md5.New()})
+	}
+	if v := get(checksumSHA256Header, part, request); v != "" {
+		want, err := decodeSHA256Digest(v)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, uploadChecksum{header: checksumSHA256Header, want: want, hash: sha256.New()})
+	}
+	return checksums, nil
+}
+
+func decodeSHA256Digest(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == sha256.Size {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%s must be a hex or base64 encoded SHA-256 digest", checksumSHA256Header)
+}
+
+// checksumWriters returns the hashes to feed while copying the upload.
+func checksumWriters(checksums []uploadChecksum) []io.Writer {
+	writers := make([]io.Writer, 0, len(checksums))
+	for _, c := range checksums {
+		writers = append(writers, c.hash)
+	}
+	return writers
+}
+
+// fileSHA256 returns the base64 SHA-256 of the rest of f, the form S3 takes
+// in ChecksumSHA256, and rewinds f to where it was.
+func fileSHA256(f io.ReadSeeker) (string, error) {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
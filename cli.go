@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/webhooks"
+	"golang.org/x/term"
+)
+
+// command is one of the binary's subcommands, such as "serve" or
+// "user create". Every command takes the same config flags as the server.
+type command struct {
+	name string
+	// args describes the positional arguments in the usage message
+	args    string
+	summary string
+	// setup registers the command's own flags and returns what runs it once
+	// they are parsed
+	setup func(fs *flag.FlagSet) runFunc
+}
+
+type runFunc func(ctx context.Context, conf config.Config, args []string) error
+
+var commands = []command{
+	{name: "serve", summary: "Run the HTTP server, the default when no command is given", setup: cmdServe},
+	{name: "migrate", summary: "Create or upgrade the database schema", setup: cmdMigrate},
+	{name: "config print", summary: "Print the resolved configuration with secrets redacted", setup: cmdConfigPrint},
+	{name: "user create", summary: "Create a user, reading the password from stdin", setup: cmdUserCreate},
+	{name: "user disable", summary: "Stop a user from signing in and sign them out everywhere", setup: cmdUserDisable},
+	{name: "user enable", summary: "Let a disabled user sign in again", setup: cmdUserEnable},
+	{name: "user reset-password", summary: "Set a user's password, reading it from stdin, and sign them out everywhere", setup: cmdUserResetPassword},
+	{name: "video list", summary: "List videos, optionally only one user's", setup: cmdVideoList},
+	{name: "video delete", args: "<video-id>", summary: "Delete a video and the stored files no other video uses", setup: cmdVideoDelete},
+	{name: "video reprocess", args: "<video-id>", summary: "Process a video's current file again and store it as a new version", setup: cmdVideoReprocess},
+	{name: "storage verify", summary: "Check that every stored video file exists with the recorded size and checksum", setup: cmdStorageVerify},
+	{name: "backup", summary: "Back up the database and assets, with a manifest of the stored objects they use", setup: cmdBackup},
+	{name: "restore", args: "<backup-file>", summary: "Check a backup's stored objects are in the bucket and restore it", setup: cmdRestore},
+	{name: "token revoke-all", summary: "Revoke every access and refresh token, or only one user's", setup: cmdTokenRevokeAll},
+}
+
+// runCommand runs the command named by the leading args and returns the exit
+// code. Without a command, or when args start with a flag, it serves.
+func runCommand(args []string) int {
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		if args[0] == "help" {
+			printUsage(os.Stdout)
+			return 0
+		}
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", strings.Join(args, " "))
+		printUsage(os.Stderr)
+		return 2
+	}
+
+	fs := flag.NewFlagSet("tubely "+cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tubely %s [flags] %s\n\n%s.\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fs.PrintDefaults()
+	}
+	loader := config.NewLoader(fs)
+	run := cmd.setup(fs)
+	fs.Parse(rest)
+
+	conf, err := loader.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return 1
+	}
+
+	// commands write their results to stdout, so their logs go to stderr
+	logOutput := os.Stderr
+	if cmd.name == "serve" {
+		logOutput = os.Stdout
+	}
+	logger, err := newLogger(logOutput, conf.Log.Format, conf.Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// also routes the standard log package through the structured logger
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, conf, fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "tubely %s: %v\n", cmd.name, err)
+		return 1
+	}
+	return 0
+}
+
+// findCommand matches the command name at the start of args and returns the
+// arguments after it.
+func findCommand(args []string) (*command, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return &commands[0], args
+	}
+	for i := range commands {
+		words := strings.Fields(commands[i].name)
+		if len(words) <= len(args) && slices.Equal(words, args[:len(words)]) {
+			return &commands[i], args[len(words):]
+		}
+	}
+	return nil, args
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, "Usage: tubely [command] [flags]\n\nCommands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprint(w, "\nRun \"tubely <command> -h\" for a command's flags.\n")
+}
+
+// withAPIConfig opens everything the server uses for a command that runs
+// against it. Events the command publishes are queued for webhooks, which a
+// running server then delivers.
+func withAPIConfig(run func(ctx context.Context, cfg *apiConfig, args []string) error) runFunc {
+	return func(ctx context.Context, conf config.Config, args []string) error {
+		cfg, err := newAPIConfig(conf)
+		if err != nil {
+			return err
+		}
+		defer cfg.db.Close()
+
+		cfg.events.Subscribe(webhooks.NewDispatcher(cfg.db, cfg.platform == "dev").Enqueue)
+		return run(ctx, cfg, args)
+	}
+}
+
+func cmdServe(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, conf config.Config, args []string) error {
+		if len(args) > 0 {
+			return fmt.Errorf("unexpected arguments %q", args)
+		}
+		return runServe(ctx, conf)
+	}
+}
+
+func cmdMigrate(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, conf config.Config, args []string) error {
+		// opening the database brings its schema up to date
+		db, err := database.NewClient(conf.DBPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Migrated %s\n", conf.DBPath)
+		return db.Close()
+	}
+}
+
+func cmdConfigPrint(fs *flag.FlagSet) runFunc {
+	return func(ctx context.Context, conf config.Config, args []string) error {
+		return config.Print(os.Stdout, conf)
+	}
+}
+
+// readPassword reads a password from stdin. On a terminal it prompts on
+// stderr without echoing and asks for it twice, otherwise it reads one line
+// so it can be piped in.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	prompt := func(label string) (string, error) {
+		fmt.Fprint(os.Stderr, label)
+		password, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(password), err
+	}
+	password, err := prompt("Password: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := prompt("Confirm password: ")
+	if err != nil {
+		return "", err
+	}
+	if password != confirm {
+		return "", errors.New("passwords don't match")
+	}
+	return password, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func cmdUserCreate(fs *flag.FlagSet) runFunc {
+	email := fs.String("email", "", "email address of the new user")
+	verified := fs.Bool("verified", false, "mark the email address as verified instead of sending a verification email")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		if *email == "" {
+			return errors.New("-email is required")
+		}
+		err := validateEmail(*email)
+		if err != nil {
+			return fmt.Errorf("invalid email address: %w", err)
+		}
+		existing, err := cfg.db.GetUserByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		if existing.ID != uuid.Nil {
+			return fmt.Errorf("a user with email %s already exists", *email)
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return fmt.Errorf("couldn't read password: %w", err)
+		}
+		if password == "" {
+			return errors.New("password is required")
+		}
+		hashedPassword, err := auth.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("couldn't hash password: %w", err)
+		}
+
+		user, err := cfg.db.CreateUser(ctx, database.CreateUserParams{
+			Email:    *email,
+			Password: hashedPassword,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't create user: %w", err)
+		}
+
+		if *verified {
+			err = cfg.db.MarkUserEmailVerified(ctx, user.ID)
+			if err != nil {
+				return fmt.Errorf("couldn't verify email: %w", err)
+			}
+		} else if err := cfg.sendVerificationEmail(ctx, *user); err != nil {
+			slog.ErrorContext(ctx, "Couldn't send verification email", "user_id", user.ID, "error", err)
+		}
+
+		fmt.Printf("Created user %s with ID %s\n", user.Email, user.ID)
+		return nil
+	})
+}
+
+func cmdUserDisable(fs *flag.FlagSet) runFunc {
+	email := fs.String("email", "", "email address of the user")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		user, err := cfg.userByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		err = cfg.db.DisableUser(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't disable user: %w", err)
+		}
+		fmt.Printf("Disabled %s and signed them out everywhere\n", user.Email)
+		return nil
+	})
+}
+
+func cmdUserEnable(fs *flag.FlagSet) runFunc {
+	email := fs.String("email", "", "email address of the user")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		user, err := cfg.userByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		err = cfg.db.EnableUser(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't enable user: %w", err)
+		}
+		fmt.Printf("Enabled %s\n", user.Email)
+		return nil
+	})
+}
+
+func cmdUserResetPassword(fs *flag.FlagSet) runFunc {
+	email := fs.String("email", "", "email address of the user")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		user, err := cfg.userByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+
+		password, err := readPassword()
+		if err != nil {
+			return fmt.Errorf("couldn't read password: %w", err)
+		}
+		if password == "" {
+			return errors.New("password is required")
+		}
+		hashedPassword, err := auth.HashPassword(password)
+		if err != nil {
+			return fmt.Errorf("couldn't hash password: %w", err)
+		}
+
+		err = cfg.db.UpdateUserPassword(ctx, user.ID, hashedPassword)
+		if err != nil {
+			return fmt.Errorf("couldn't update password: %w", err)
+		}
+		// whoever knew the old password shouldn't stay signed in, and the
+		// owner shouldn't stay locked out
+		err = cfg.db.RevokeUserTokens(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't revoke sessions: %w", err)
+		}
+		err = cfg.db.ResetFailedLogins(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't reset failed logins: %w", err)
+		}
+
+		fmt.Printf("Reset the password of %s and signed them out everywhere\n", user.Email)
+		return nil
+	})
+}
+
+func cmdTokenRevokeAll(fs *flag.FlagSet) runFunc {
+	email := fs.String("email", "", "only revoke this user's tokens")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		if *email == "" {
+			err := cfg.db.RevokeAllTokens(ctx)
+			if err != nil {
+				return fmt.Errorf("couldn't revoke tokens: %w", err)
+			}
+			fmt.Println("Revoked every user's tokens")
+			return nil
+		}
+
+		user, err := cfg.userByEmail(ctx, *email)
+		if err != nil {
+			return err
+		}
+		err = cfg.db.RevokeUserTokens(ctx, user.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't revoke tokens: %w", err)
+		}
+		fmt.Printf("Revoked the tokens of %s\n", user.Email)
+		return nil
+	})
+}
+
+// userByEmail looks up the user a command's -email flag names.
+func (cfg *apiConfig) userByEmail(ctx context.Context, email string) (database.User, error) {
+	if email == "" {
+		return database.User{}, errors.New("-email is required")
+	}
+	user, err := cfg.db.GetUserByEmail(ctx, email)
+	if err != nil {
+		return database.User{}, fmt.Errorf("couldn't get user: %w", err)
+	}
+	if user.ID == uuid.Nil {
+		return database.User{}, fmt.Errorf("no user with email %s", email)
+	}
+	return user, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+	"github.com/google/uuid"
+)
+
+func cmdVideoList(fs *flag.FlagSet) runFunc {
+	email := fs.String("user", "", "only list videos of the user with this email address")
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		var videos []database.Video
+		var err error
+		if *email != "" {
+			var user database.User
+			user, err = cfg.userByEmail(ctx, *email)
+			if err != nil {
+				return err
+			}
+			videos, err = cfg.db.GetVideos(ctx, user.ID)
+		} else {
+			videos, err = cfg.db.GetAllVideos(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't get videos: %w", err)
+		}
+
+		users, err := cfg.db.GetUsers(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't get users: %w", err)
+		}
+		emails := make(map[uuid.UUID]string, len(users))
+		for _, user := range users {
+			emails[user.ID] = user.Email
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tOWNER\tVISIBILITY\tUPLOADED\tTITLE")
+		for _, video := range videos {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%s\n",
+				video.ID,
+				video.CreatedAt.Format("2006-01-02 15:04"),
+				emails[video.UserID],
+				video.Visibility,
+				video.CurrentVersionID != nil,
+				video.Title,
+			)
+		}
+		return tw.Flush()
+	})
+}
+
+func cmdVideoDelete(fs *flag.FlagSet) runFunc {
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		video, err := cfg.videoFromArgs(ctx, args)
+		if err != nil {
+			return err
+		}
+		err = cfg.deleteVideo(ctx, video)
+		if err != nil {
+			return fmt.Errorf("couldn't delete video: %w", err)
+		}
+		fmt.Printf("Deleted video %s\n", video.ID)
+		return nil
+	})
+}
+
+func cmdVideoReprocess(fs *flag.FlagSet) runFunc {
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		video, err := cfg.videoFromArgs(ctx, args)
+		if err != nil {
+			return err
+		}
+		video, err = cfg.reprocessVideo(ctx, video)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reprocessed video %s, it's now at %s\n", video.ID, *video.VideoURL)
+		return nil
+	})
+}
+
+// videoFromArgs looks up the video whose ID is a command's only argument.
+func (cfg *apiConfig) videoFromArgs(ctx context.Context, args []string) (database.Video, error) {
+	if len(args) != 1 {
+		return database.Video{}, errors.New("expected a video ID")
+	}
+	videoID, err := uuid.Parse(args[0])
+	if err != nil {
+		return database.Video{}, fmt.Errorf("invalid video ID: %w", err)
+	}
+	video, err := cfg.db.GetVideo(ctx, videoID)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't get video: %w", err)
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, fmt.Errorf("no video with ID %s", videoID)
+	}
+	return video, nil
+}
+
+// reprocessVideo runs a video's current file through processing again, such
+// as after ffmpeg is upgraded, and stores the result as a new version. The
+// original upload isn't kept, so the stored file is the input.
+func (cfg *apiConfig) reprocessVideo(ctx context.Context, video database.Video) (database.Video, error) {
+	if video.CurrentVersionID == nil {
+		return video, errors.New("video has no file to reprocess")
+	}
+	current, err := cfg.db.GetVideoVersion(ctx, *video.CurrentVersionID)
+	if err != nil {
+		return video, fmt.Errorf("couldn't get current version: %w", err)
+	}
+	mediaType := "video/mp4"
+	if current.ContentType != nil {
+		mediaType = *current.ContentType
+	}
+
+	tmpVideo, err := os.CreateTemp("", "tubely-upload.mp4")
+	if err != nil {
+		return video, fmt.Errorf("failed to create temp video file: %w", err)
+	}
+	defer os.Remove(tmpVideo.Name())
+	defer tmpVideo.Close()
+
+	object, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(current.Bucket),
+		Key:    aws.String(current.Key),
+	})
+	if err != nil {
+		return video, fmt.Errorf("couldn't download %s: %w", current.Key, err)
+	}
+	defer object.Body.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpVideo, hasher), object.Body)
+	if err != nil {
+		return video, fmt.Errorf("couldn't download %s: %w", current.Key, err)
+	}
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
+
+	// the same file has been processed before, so its result can be reused
+	_, reused, err := cfg.db.CreateVideoVersionFromBlob(ctx, video.ID, contentHash, video.UserID)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video: %w", err)
+	}
+	if !reused {
+		params, message, err := cfg.processUpload(ctx, video, tmpVideo.Name(), mediaType, contentHash)
+		if err != nil {
+			return video, fmt.Errorf("%s: %w", message, err)
+		}
+		params.UploadedBy = video.UserID
+
+		_, err = cfg.db.CreateVideoVersion(ctx, params)
+		if err != nil {
+			return video, fmt.Errorf("couldn't update video: %w", err)
+		}
+	}
+
+	video, err = cfg.db.GetVideo(ctx, video.ID)
+	if err != nil {
+		return video, fmt.Errorf("couldn't update video: %w", err)
+	}
+	cfg.pruneVideoVersions(ctx, video)
+
+	cfg.events.Publish(ctx, events.Event{
+		Type:    events.VideoProcessed,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+	return video, nil
+}
+
+func cmdStorageVerify(fs *flag.FlagSet) runFunc {
+	return withAPIConfig(func(ctx context.Context, cfg *apiConfig, args []string) error {
+		versions, err := cfg.db.GetAllVideoVersions(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't get video versions: %w", err)
+		}
+
+		// versions of deduplicated uploads share objects, so each is only
+		// checked once
+		checked := map[string]error{}
+		problems := 0
+		for _, version := range versions {
+			problem, ok := checked[version.StorageURL()]
+			if !ok {
+				problem = verifyStoredObject(ctx, cfg.s3Client, storedObjectOf(version))
+				checked[version.StorageURL()] = problem
+			}
+			if problem != nil {
+				problems++
+				fmt.Printf("video %s version %d: %s/%s: %v\n", version.VideoID, version.Version, version.Bucket, version.Key, problem)
+			}
+		}
+
+		fmt.Printf("Checked %d objects for %d versions, %d problems\n", len(checked), len(versions), problems)
+		if problems > 0 {
+			return fmt.Errorf("%d versions have missing or damaged files", problems)
+		}
+		return nil
+	})
+}
+
+// storedObject is a file in storage along with what was recorded about it
+// when it was uploaded.
+type storedObject struct {
+	Bucket         string  `json:"bucket"`
+	Key            string  `json:"key"`
+	SizeBytes      *int64  `json:"size_bytes"`
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+}
+
+func storedObjectOf(version database.VideoVersion) storedObject {
+	return storedObject{
+		Bucket:         version.Bucket,
+		Key:            version.Key,
+		SizeBytes:      version.SizeBytes,
+		ChecksumSHA256: version.ChecksumSHA256,
+	}
+}
+
+// verifyStoredObject checks that an object exists and matches the size and
+// checksum recorded when it was uploaded. Objects from before either was
+// recorded are only checked for what they have.
+func verifyStoredObject(ctx context.Context, client *s3.Client, object storedObject) error {
+	out, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:       aws.String(object.Bucket),
+		Key:          aws.String(object.Key),
+		ChecksumMode: types.ChecksumModeEnabled,
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return errors.New("missing")
+		}
+		return err
+	}
+
+	if object.SizeBytes != nil && out.ContentLength != nil && *out.ContentLength != *object.SizeBytes {
+		return fmt.Errorf("size is %d bytes, expected %d", *out.ContentLength, *object.SizeBytes)
+	}
+	if object.ChecksumSHA256 != nil && out.ChecksumSHA256 != nil && *out.ChecksumSHA256 != *object.ChecksumSHA256 {
+		return fmt.Errorf("SHA-256 checksum is %s, expected %s", *out.ChecksumSHA256, *object.ChecksumSHA256)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	exportWorkerInterval = 5 * time.Second
+	// exportTTL is how long a finished export can be downloaded. Presigned
+	// links can't be valid for more than 7 days.
+	exportTTL = 72 * time.Hour
+	// exportClaimTTL is how long an export being built stays claimed without
+	// being renewed. Once it's over, the server building it is assumed to be
+	// gone and another one takes it over.
+	exportClaimTTL = 5 * time.Minute
+	// exportClaimRenewInterval is how often the server building an export
+	// renews its claim.
+	exportClaimRenewInterval = time.Minute
+)
+
+// runExportWorker builds requested exports one at a time and deletes expired
+// ones until ctx is cancelled.
+func (cfg *apiConfig) runExportWorker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		cfg.expireExports(ctx, time.Now().UTC())
+		for ctx.Err() == nil && cfg.buildNextExport(ctx) {
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// buildNextExport builds the oldest pending export, or one abandoned by
+// another server, and reports whether there was one.
+func (cfg *apiConfig) buildNextExport(ctx context.Context) bool {
+	now := time.Now().UTC()
+	export, ok, err := cfg.db.ClaimPendingExport(ctx, now, now.Add(-exportClaimTTL))
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't get pending exports", "error", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	start := time.Now()
+	stopRenewing := cfg.keepExportClaimed(ctx, export.ID)
+	export, err = cfg.buildExport(ctx, export)
+	stopRenewing()
+	if err != nil {
+		// interrupted by shutdown, so put it back for this or another server
+		// to build
+		if ctx.Err() != nil {
+			if err := cfg.db.ReleaseExport(context.WithoutCancel(ctx), export.ID); err != nil {
+				slog.Error("Couldn't requeue interrupted export", "export_id", export.ID, "error", err)
+			}
+			return false
+		}
+		// another server took it over after the claim lapsed, or it was
+		// cancelled, so whoever has it now decides what happens to it
+		if errors.Is(err, database.ErrExportClaimLost) {
+			slog.WarnContext(ctx, "Lost claim on export", "export_id", export.ID, "user_id", export.UserID)
+			return true
+		}
+		slog.ErrorContext(ctx, "Couldn't build export", "export_id", export.ID, "user_id", export.UserID, "error", err)
+		if err := cfg.db.FailExport(ctx, export.ID, "Couldn't build export"); err != nil {
+			slog.ErrorContext(ctx, "Couldn't record failed export", "export_id", export.ID, "error", err)
+		}
+		return true
+	}
+	slog.InfoContext(ctx, "Built export", "export_id", export.ID, "user_id", export.UserID, "bytes", *export.SizeBytes, "duration_ms", time.Since(start).Milliseconds())
+
+	if err := cfg.sendExportReadyEmail(ctx, export); err != nil {
+		slog.ErrorContext(ctx, "Couldn't send export email", "export_id", export.ID, "error", err)
+	}
+	return true
+}
+
+// keepExportClaimed renews the claim on an export until the returned
+// function is called, so exports that take longer than exportClaimTTL to
+// build aren't taken over by another server.
+func (cfg *apiConfig) keepExportClaimed(ctx context.Context, id uuid.UUID) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(exportClaimRenewInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := cfg.db.RenewExportClaim(ctx, id, time.Now().UTC()); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Couldn't renew export claim", "export_id", id, "error", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// exportedVideo is a video's entry in videos.json.
+type exportedVideo struct {
+	database.Video
+	Versions []database.VideoVersion `json:"versions"`
+	// File and ThumbnailFile are where the video's current file and its
+	// thumbnail are in the archive, if it has them
+	File          *string `json:"file"`
+	ThumbnailFile *string `json:"thumbnail_file"`
+}
+
+// buildExport writes a ZIP of the user's profile, video metadata, thumbnails
+// and current video files and stores it next to the videos.
+func (cfg *apiConfig) buildExport(ctx context.Context, export database.Export) (database.Export, error) {
+	type profile struct {
+		ID              uuid.UUID  `json:"id"`
+		Email           string     `json:"email"`
+		CreatedAt       time.Time  `json:"created_at"`
+		UpdatedAt       time.Time  `json:"updated_at"`
+		EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	}
+
+	user, err := cfg.db.GetUser(ctx, export.UserID)
+	if err != nil {
+		return export, err
+	}
+	if user == nil {
+		return export, errors.New("user no longer exists")
+	}
+	videos, err := cfg.db.GetVideos(ctx, export.UserID)
+	if err != nil {
+		return export, err
+	}
+
+	tmpFile, err := os.CreateTemp("", "tubely-export*.zip")
+	if err != nil {
+		return export, err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+
+	zw := zip.NewWriter(tmpFile)
+	err = addJSONToZip(zw, "profile.json", profile{
+		ID:              user.ID,
+		Email:           user.Email,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+		EmailVerifiedAt: user.EmailVerifiedAt,
+	})
+	if err != nil {
+		return export, err
+	}
+
+	exported := make([]exportedVideo, 0, len(videos))
+	for _, video := range videos {
+		entry, err := cfg.addVideoToZip(ctx, zw, video)
+		if err != nil {
+			return export, fmt.Errorf("couldn't add video %s: %w", video.ID, err)
+		}
+		exported = append(exported, entry)
+	}
+	if err := addJSONToZip(zw, "videos.json", exported); err != nil {
+		return export, err
+	}
+	if err := zw.Close(); err != nil {
+		return export, err
+	}
+
+	info, err := tmpFile.Stat()
+	if err != nil {
+		return export, err
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		return export, err
+	}
+	key := path.Join("exports", export.UserID.String(), export.ID.String()+".zip")
+	// archives of large libraries are over the 5 GB a single PUT can take,
+	// so upload in parts, big enough to stay within the parts S3 allows
+	uploader := manager.NewUploader(cfg.s3Client, func(u *manager.Uploader) {
+		u.PartSize = max(manager.DefaultUploadPartSize, info.Size()/int64(manager.MaxUploadParts)+1)
+	})
+	_, err = uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(cfg.s3Bucket),
+		Key:                aws.String(key),
+		Body:               tmpFile,
+		ContentType:        aws.String("application/zip"),
+		ContentDisposition: aws.String(`attachment; filename="tubely-export.zip"`),
+	})
+	if err != nil {
+		return export, fmt.Errorf("couldn't upload export: %w", err)
+	}
+
+	completed, err := cfg.db.CompleteExport(ctx, database.CompleteExportParams{
+		ID:        export.ID,
+		Bucket:    cfg.s3Bucket,
+		Key:       key,
+		SizeBytes: info.Size(),
+		ExpiresAt: time.Now().UTC().Add(exportTTL),
+	})
+	if errors.Is(err, database.ErrExportClaimLost) {
+		cfg.deleteCancelledExportArchive(ctx, export.ID, database.StorageObject{Bucket: cfg.s3Bucket, Key: key})
+	}
+	if err != nil {
+		return export, err
+	}
+	return completed, nil
+}
+
+// deleteCancelledExportArchive deletes an archive uploaded after its export
+// was cancelled, e.g. because the account is being deleted. An export that
+// another server took over uploads to the same key, so its archive is left
+// alone.
+func (cfg *apiConfig) deleteCancelledExportArchive(ctx context.Context, id uuid.UUID, object database.StorageObject) {
+	export, err := cfg.db.GetExport(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't check cancelled export", "export_id", id, "error", err)
+		return
+	}
+	if export.ID != uuid.Nil && export.Status != database.ExportStatusFailed {
+		return
+	}
+	if err := cfg.deleteStorageObject(ctx, object); err != nil {
+		slog.ErrorContext(ctx, "Couldn't delete cancelled export", "export_id", id, "error", err)
+	}
+}
+
+// addVideoToZip adds a video's thumbnail and current file, streamed from
+// storage, and returns its metadata.
+func (cfg *apiConfig) addVideoToZip(ctx context.Context, zw *zip.Writer, video database.Video) (exportedVideo, error) {
+	versions, err := cfg.db.GetVideoVersions(ctx, video.ID)
+	if err != nil {
+		return exportedVideo{}, err
+	}
+	entry := exportedVideo{Video: video, Versions: versions}
+
+	if thumbnailPath, ok := cfg.thumbnailPath(video); ok {
+		name := "thumbnails/" + video.ID.String() + filepath.Ext(thumbnailPath)
+		err := addFileToZip(zw, name, thumbnailPath)
+		if err == nil {
+			entry.ThumbnailFile = &name
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return exportedVideo{}, err
+		}
+	}
+
+	for _, version := range versions {
+		if video.CurrentVersionID == nil || version.ID != *video.CurrentVersionID {
+			continue
+		}
+		mediaType := "video/mp4"
+		if version.ContentType != nil {
+			mediaType = *version.ContentType
+		}
+		name := "videos/" + video.ID.String() + mediaTypeToExt(mediaType)
+		if err := cfg.addObjectToZip(ctx, zw, name, version); err != nil {
+			return exportedVideo{}, err
+		}
+		entry.File = &name
+	}
+	return entry, nil
+}
+
+func (cfg *apiConfig) addObjectToZip(ctx context.Context, zw *zip.Writer, name string, version database.VideoVersion) error {
+	object, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(version.Bucket),
+		Key:    aws.String(version.Key),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	// videos are already compressed, so they're stored as they are
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: version.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, object.Body)
+	return err
+}
+
+// thumbnailPath returns where a video's thumbnail is in the assets
+// directory, if it's stored there.
+func (cfg *apiConfig) thumbnailPath(video database.Video) (string, bool) {
+	if video.ThumbnailURL == nil {
+		return "", false
+	}
+	u, err := url.Parse(*video.ThumbnailURL)
+	if err != nil || u.Scheme == "data" {
+		return "", false
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", false
+	}
+	return filepath.Join(cfg.assetsRoot, name), true
+}
+
+func addJSONToZip(zw *zip.Writer, name string, v any) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func addFileToZip(zw *zip.Writer, name, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// expireExports deletes the archives of exports past their expiry.
+func (cfg *apiConfig) expireExports(ctx context.Context, now time.Time) {
+	exports, err := cfg.db.GetExpiredExports(ctx, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't get expired exports", "error", err)
+		return
+	}
+	for _, export := range exports {
+		if export.Bucket != nil && export.Key != nil {
+			err := cfg.deleteStorageObject(ctx, database.StorageObject{Bucket: *export.Bucket, Key: *export.Key})
+			if err != nil {
+				slog.ErrorContext(ctx, "Couldn't delete expired export", "export_id", export.ID, "error", err)
+				continue
+			}
+		}
+		if err := cfg.db.MarkExportExpired(ctx, export.ID); err != nil {
+			slog.ErrorContext(ctx, "Couldn't mark export expired", "export_id", export.ID, "error", err)
+		}
+	}
+}
+
+// exportDownloadURL presigns a link to a ready export that lasts until it
+// expires.
+func (cfg *apiConfig) exportDownloadURL(export database.Export) (string, error) {
+	if export.Status != database.ExportStatusReady || export.Bucket == nil || export.Key == nil || export.ExpiresAt == nil {
+		return "", errors.New("export isn't ready")
+	}
+	return generatePresignedURL(cfg.s3Client, *export.Bucket, *export.Key, time.Until(*export.ExpiresAt))
+}
+
+func (cfg *apiConfig) sendExportReadyEmail(ctx context.Context, export database.Export) error {
+	user, err := cfg.db.GetUser(ctx, export.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("user no longer exists")
+	}
+	link, err := cfg.exportDownloadURL(export)
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your Tubely data export is ready",
+		Body: fmt.Sprintf(
+			"The export of your Tubely account you asked for is ready.\n\nDownload it here:\n\n%s\n\nThe link expires on %s, after which the export is deleted.\n",
+			link, export.ExpiresAt.Format("2 January 2006 at 15:04 MST"),
+		),
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerAccountDelete schedules the user's account to be deleted once the
+// grace period is over and signs them out everywhere. The user is emailed a
+// link to undo it. Users who signed up through OIDC don't have a password
+// they know, so without one the user is instead emailed a link to confirm
+// the deletion with.
+func (cfg *apiConfig) handlerAccountDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+	type response struct {
+		DeleteAfter *time.Time `json:"delete_after,omitempty"`
+		// ConfirmationSent is set when the deletion has to be confirmed
+		// with the link in the email first
+		ConfirmationSent bool `json:"confirmation_sent,omitempty"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user", err)
+		return
+	}
+
+	if params.Password == "" {
+		err = cfg.sendAccountDeletionConfirmationEmail(r.Context(), *user)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't send confirmation email", err)
+			return
+		}
+		respondWithJSON(w, http.StatusAccepted, response{ConfirmationSent: true})
+		return
+	}
+
+	// a stolen access token shouldn't be enough to guess the password with
+	if cfg.respondIfLocked(r.Context(), w, user.ID) {
+		return
+	}
+	err = auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		cfg.recordFailedLogin(r.Context(), user.ID)
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+		return
+	}
+
+	deleteAfter, err := cfg.scheduleAccountDeletion(r.Context(), *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't schedule account deletion", err)
+		return
+	}
+	respondWithJSON(w, http.StatusAccepted, response{DeleteAfter: &deleteAfter})
+}
+
+// handlerAccountDeletionConfirm schedules the deletion of an account with the
+// token from the email sent when it was requested without a password.
+func (cfg *apiConfig) handlerAccountDeletionConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+	type response struct {
+		DeleteAfter time.Time `json:"delete_after"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Token), database.UserTokenPurposeConfirmDeletion)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check confirmation token", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired confirmation token", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user", err)
+		return
+	}
+	// already scheduled or disabled accounts are left as they are
+	if cfg.respondIfDisabled(r.Context(), w, user.ID) {
+		return
+	}
+
+	deleteAfter, err := cfg.scheduleAccountDeletion(r.Context(), *user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't schedule account deletion", err)
+		return
+	}
+	err = cfg.db.InvalidateUserTokens(r.Context(), user.ID, database.UserTokenPurposeConfirmDeletion)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't invalidate confirmation tokens", "user_id", user.ID, "error", err)
+	}
+	respondWithJSON(w, http.StatusAccepted, response{DeleteAfter: deleteAfter})
+}
+
+// handlerAccountDeletionCancel undoes a scheduled account deletion with the
+// token from the email sent when it was requested. The user has been signed
+// out, so the token is the only proof of who they are.
+func (cfg *apiConfig) handlerAccountDeletionCancel(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Token), database.UserTokenPurposeCancelDeletion)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check cancellation token", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired cancellation token", nil)
+		return
+	}
+
+	cancelled, err := cfg.db.CancelUserDeletion(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't cancel account deletion", err)
+		return
+	}
+	if !cancelled {
+		respondWithError(w, http.StatusConflict, "Account isn't scheduled for deletion", nil)
+		return
+	}
+	err = cfg.db.InvalidateUserTokens(r.Context(), userID, database.UserTokenPurposeCancelDeletion)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Couldn't invalidate cancellation tokens", "user_id", userID, "error", err)
+	}
+	slog.InfoContext(r.Context(), "Cancelled account deletion", "user_id", userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
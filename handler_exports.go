@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type exportResponse struct {
+	database.Export
+	// DownloadURL is a fresh presigned link while the export is ready
+	DownloadURL *string `json:"download_url"`
+}
+
+// handlerExportCreate queues an archive of everything the user has stored.
+// It's built in the background and emailed to the user when it's ready.
+func (cfg *apiConfig) handlerExportCreate(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	active, err := cfg.db.GetActiveExport(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check exports", err)
+		return
+	}
+	if active.ID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, "An export is already being prepared", nil)
+		return
+	}
+
+	export, err := cfg.db.CreateExport(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create export", err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/me/exports/"+export.ID.String())
+	respondWithJSON(w, http.StatusAccepted, exportResponse{Export: export})
+}
+
+func (cfg *apiConfig) handlerExportGet(w http.ResponseWriter, r *http.Request) {
+	exportIDString := r.PathValue("exportID")
+	exportID, err := uuid.Parse(exportIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	export, err := cfg.db.GetExport(r.Context(), exportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get export", err)
+		return
+	}
+	if export.ID == uuid.Nil || export.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get export", nil)
+		return
+	}
+
+	response := exportResponse{Export: export}
+	if export.Status == database.ExportStatusReady {
+		url, err := cfg.exportDownloadURL(export)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+		response.DownloadURL = &url
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
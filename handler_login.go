@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
@@ -28,41 +32,41 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := cfg.db.GetUserByEmail(params.Email)
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
 
+	if user.ID != uuid.Nil && cfg.respondIfLocked(r.Context(), w, user.ID) {
+		return
+	}
+
 	err = auth.CheckPasswordHash(params.Password, user.Password)
 	if err != nil {
+		if user.ID != uuid.Nil {
+			cfg.recordFailedLogin(r.Context(), user.ID)
+		}
 		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
 		return
 	}
+	if cfg.respondIfDisabled(r.Context(), w, user.ID) {
+		return
+	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+	if cfg.respondIfMFARequired(r.Context(), w, user.ID) {
 		return
 	}
 
-	refreshToken, err := auth.MakeRefreshToken()
+	err = cfg.db.ResetFailedLogins(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset failed logins", err)
 		return
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
-		UserID:    user.ID,
-		Token:     refreshToken,
-		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
-	})
+	accessToken, refreshToken, err := cfg.issueTokens(r.Context(), user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
 		return
 	}
 
@@ -72,3 +76,116 @@ func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 		RefreshToken: refreshToken,
 	})
 }
+
+const (
+	// lockoutThreshold is the number of consecutive failed logins allowed
+	// before an account is locked
+	lockoutThreshold = 5
+	lockoutBase      = 30 * time.Second
+	lockoutMax       = time.Hour
+)
+
+// lockoutDuration doubles for every failure past the threshold, up to
+// lockoutMax.
+func lockoutDuration(failures int) time.Duration {
+	if failures < lockoutThreshold {
+		return 0
+	}
+	d := lockoutBase
+	for i := lockoutThreshold; i < failures && d < lockoutMax; i++ {
+		d *= 2
+	}
+	return min(d, lockoutMax)
+}
+
+// recordFailedLogin counts a failed password or second factor attempt and
+// locks the account once there have been too many in a row.
+func (cfg *apiConfig) recordFailedLogin(ctx context.Context, userID uuid.UUID) {
+	failures, err := cfg.db.RecordFailedLogin(ctx, userID)
+	if err != nil {
+		slog.Error("Couldn't record failed login", "user_id", userID, "error", err)
+		return
+	}
+	d := lockoutDuration(failures)
+	if d == 0 {
+		return
+	}
+	err = cfg.db.LockUser(ctx, userID, time.Now().UTC().Add(d))
+	if err != nil {
+		slog.Error("Couldn't lock user", "user_id", userID, "error", err)
+	}
+}
+
+// respondIfLocked responds with 429 and returns true if the account is
+// locked.
+func (cfg *apiConfig) respondIfLocked(ctx context.Context, w http.ResponseWriter, userID uuid.UUID) bool {
+	lockedUntil, err := cfg.db.GetUserLockedUntil(ctx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check account lockout", err)
+		return true
+	}
+	if lockedUntil == nil || !time.Now().UTC().Before(*lockedUntil) {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(time.Until(*lockedUntil))))
+	respondWithError(w, http.StatusTooManyRequests, "Account temporarily locked after too many failed logins", nil)
+	return true
+}
+
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// respondIfMFARequired responds with an MFA challenge and returns true if the
+// user has a second factor, which they then have to complete with
+// POST /api/login/mfa. Every way of signing in goes through this.
+func (cfg *apiConfig) respondIfMFARequired(ctx context.Context, w http.ResponseWriter, userID uuid.UUID) bool {
+	totp, err := cfg.db.GetUserTOTP(ctx, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA settings", err)
+		return true
+	}
+	if totp.EnabledAt == nil {
+		return false
+	}
+	mfaToken, err := auth.MakeMFAToken(userID, cfg.jwtKeys, mfaChallengeTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create MFA token", err)
+		return true
+	}
+	respondWithJSON(w, http.StatusOK, mfaChallengeResponse{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+	})
+	return true
+}
+
+// issueTokens creates the access JWT and a stored refresh token for a user
+// who has just authenticated.
+func (cfg *apiConfig) issueTokens(ctx context.Context, userID uuid.UUID) (string, string, error) {
+	accessToken, err := auth.MakeJWT(
+		userID,
+		cfg.jwtKeys,
+		time.Hour*24*30,
+	)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't create access JWT: %w", err)
+	}
+
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't create refresh token: %w", err)
+	}
+
+	_, err = cfg.db.CreateRefreshToken(ctx, database.CreateRefreshTokenParams{
+		UserID:    userID,
+		Token:     refreshToken,
+		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't save refresh token: %w", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+	totpIssuer        = "Tubely"
+)
+
+func (cfg *apiConfig) handlerLoginMFA(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(params.MFAToken, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Invalid or expired MFA token", err)
+		return
+	}
+
+	if cfg.respondIfLocked(r.Context(), w, userID) || cfg.respondIfDisabled(r.Context(), w, userID) {
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA settings", err)
+		return
+	}
+	if totp.EnabledAt == nil {
+		respondWithError(w, http.StatusBadRequest, "Two-factor authentication is not enabled", nil)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(r.Context(), totp, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		cfg.recordFailedLogin(r.Context(), userID)
+		respondWithError(w, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	err = cfg.db.ResetFailedLogins(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't reset failed logins", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't get user", err)
+		return
+	}
+
+	accessToken, refreshToken, err := cfg.issueTokens(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:         *user,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user", err)
+		return
+	}
+
+	existing, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA settings", err)
+		return
+	}
+	if existing.EnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate secret", err)
+		return
+	}
+
+	err = cfg.db.SetPendingUserTOTP(r.Context(), userID, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save secret", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(totpIssuer, user.Email, secret),
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPVerify(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA settings", err)
+		return
+	}
+	if totp.Secret == "" {
+		respondWithError(w, http.StatusBadRequest, "Start enrollment first", nil)
+		return
+	}
+	if totp.EnabledAt != nil {
+		respondWithError(w, http.StatusConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(r.Context(), totp, params.Code, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, "Invalid code", nil)
+		return
+	}
+
+	recoveryCodes, err := cfg.replaceRecoveryCodes(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create recovery codes", err)
+		return
+	}
+
+	err = cfg.db.EnableUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't enable two-factor authentication", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	totp, err := cfg.db.GetUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get MFA settings", err)
+		return
+	}
+	if totp.EnabledAt == nil {
+		respondWithError(w, http.StatusBadRequest, "Two-factor authentication is not enabled", nil)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(r.Context(), totp, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code", nil)
+		return
+	}
+
+	err = cfg.db.DeleteUserTOTP(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't disable two-factor authentication", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkSecondFactor accepts either a current TOTP code or an unused recovery
+// code. Both are single use.
+func (cfg *apiConfig) checkSecondFactor(ctx context.Context, totp database.UserTOTP, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		hash := auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode))
+		return cfg.db.ConsumeRecoveryCode(ctx, totp.UserID, hash)
+	}
+
+	step, ok := auth.ValidateTOTP(totp.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return cfg.db.UseTOTPStep(ctx, totp.UserID, step)
+}
+
+func (cfg *apiConfig) replaceRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashToken(code))
+	}
+	err = cfg.db.ReplaceRecoveryCodes(ctx, userID, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
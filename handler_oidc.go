@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcLoginStateTTL = 10 * time.Minute
+	// oidcLoginCodeTTL is how long the app has to exchange the code it's
+	// redirected back with for a session
+	oidcLoginCodeTTL = time.Minute
+	// oidcStateCookie holds the state of a login started in the browser, so
+	// a callback can't be completed in a different one
+	oidcStateCookie = "tubely_oidc_state"
+)
+
+func (cfg *apiConfig) handlerOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	state, err := oidc.NewRandomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login state", err)
+		return
+	}
+	nonce, err := oidc.NewRandomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login state", err)
+		return
+	}
+	codeVerifier, err := oidc.NewRandomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login state", err)
+		return
+	}
+
+	err = cfg.db.CreateOIDCLoginState(r.Context(), database.OIDCLoginState{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().UTC().Add(oidcLoginStateTTL),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't save login state", err)
+		return
+	}
+
+	authURL, err := cfg.oidcProvider.AuthCodeURL(r.Context(), state, nonce, codeVerifier)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't reach identity provider", err)
+		return
+	}
+
+	http.SetCookie(w, cfg.oidcStateCookie(state, int(oidcLoginStateTTL.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// oidcStateCookie returns the cookie tying a login's state to the browser
+// that started it. A negative maxAge deletes it.
+func (cfg *apiConfig) oidcStateCookie(state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(cfg.publicBaseURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// handlerOIDCCallback is where the identity provider sends the browser back
+// to. It signs the user in and redirects to the app with a short-lived,
+// single-use code, which the app exchanges for a session with
+// handlerOIDCExchange, so no tokens end up in the address bar or history.
+func (cfg *apiConfig) handlerOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if idpError := query.Get("error"); idpError != "" {
+		err := fmt.Errorf("identity provider error: %s: %s", idpError, query.Get("error_description"))
+		respondWithError(w, http.StatusUnauthorized, "Login was not completed", err)
+		return
+	}
+
+	// a state and code from someone else's login mustn't sign this browser
+	// in to their account
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		respondWithError(w, http.StatusBadRequest, "Login wasn't started in this browser", err)
+		return
+	}
+	http.SetCookie(w, cfg.oidcStateCookie("", -1))
+
+	state, err := cfg.db.ConsumeOIDCLoginState(r.Context(), query.Get("state"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get login state", err)
+		return
+	}
+	if state.State == "" || time.Now().UTC().After(state.ExpiresAt) {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login state", nil)
+		return
+	}
+
+	code := query.Get("code")
+	if code == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing authorization code", nil)
+		return
+	}
+
+	rawIDToken, err := cfg.oidcProvider.Exchange(r.Context(), code, state.CodeVerifier)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't exchange authorization code", err)
+		return
+	}
+
+	claims, err := cfg.oidcProvider.VerifyIDToken(r.Context(), rawIDToken, state.Nonce)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate ID token", err)
+		return
+	}
+
+	user, err := cfg.resolveOIDCUser(r.Context(), claims)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't sign in user", err)
+		return
+	}
+	if cfg.respondIfDisabled(r.Context(), w, user.ID) {
+		return
+	}
+
+	loginCode, err := cfg.createUserToken(r.Context(), user.ID, database.UserTokenPurposeOIDCLogin, oidcLoginCodeTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create login code", err)
+		return
+	}
+	http.Redirect(w, r, "/app/?oidc_code="+url.QueryEscape(loginCode), http.StatusFound)
+}
+
+// handlerOIDCExchange swaps the code the app was redirected back with after
+// an OIDC login for a session, or an MFA challenge if the user has a second
+// factor.
+func (cfg *apiConfig) handlerOIDCExchange(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		database.User
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Code), database.UserTokenPurposeOIDCLogin)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check login code", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired login code", nil)
+		return
+	}
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user", err)
+		return
+	}
+	if cfg.respondIfDisabled(r.Context(), w, user.ID) {
+		return
+	}
+	// the identity provider's login doesn't replace the user's own second
+	// factor, since accounts are linked by email
+	if cfg.respondIfMFARequired(r.Context(), w, user.ID) {
+		return
+	}
+
+	accessToken, refreshToken, err := cfg.issueTokens(r.Context(), user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create session", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:         *user,
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// resolveOIDCUser finds the user linked to an external identity. Unknown
+// identities are linked to an existing account with the same verified email,
+// or a new account is provisioned for them.
+func (cfg *apiConfig) resolveOIDCUser(ctx context.Context, claims oidc.IDTokenClaims) (database.User, error) {
+	issuer := cfg.oidcProvider.Issuer()
+
+	identity, err := cfg.db.GetUserIdentity(ctx, issuer, claims.Subject)
+	if err != nil {
+		return database.User{}, err
+	}
+	if identity.Subject != "" {
+		user, err := cfg.db.GetUser(ctx, identity.UserID)
+		if err != nil {
+			return database.User{}, err
+		}
+		if user == nil {
+			return database.User{}, fmt.Errorf("identity %s links to missing user %s", claims.Subject, identity.UserID)
+		}
+		return *user, nil
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return database.User{}, errors.New("identity provider did not return a verified email")
+	}
+
+	user, err := cfg.db.GetUserByEmail(ctx, claims.Email)
+	if err != nil {
+		return database.User{}, err
+	}
+	if user.ID == uuid.Nil {
+		// SSO users have no Tubely password, so store a hash of a random
+		// value nobody knows
+		randomPassword, err := auth.MakeRefreshToken()
+		if err != nil {
+			return database.User{}, err
+		}
+		hashedPassword, err := auth.HashPassword(randomPassword)
+		if err != nil {
+			return database.User{}, err
+		}
+		created, err := cfg.db.CreateUser(ctx, database.CreateUserParams{
+			Email:    claims.Email,
+			Password: hashedPassword,
+		})
+		if err != nil {
+			return database.User{}, err
+		}
+		user = *created
+	}
+
+	err = cfg.db.CreateUserIdentity(ctx, database.UserIdentity{
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		UserID:  user.ID,
+		Email:   claims.Email,
+	})
+	if err != nil {
+		return database.User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc/oidctest"
+)
+
+func newOIDCTestConfig(t *testing.T) (*apiConfig, *oidctest.Server) {
+	t.Helper()
+	idp, err := oidctest.NewServer("tubely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "tubely.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &apiConfig{
+		db:      db,
+		jwtKeys: auth.NewHMACKeySet("test-secret"),
+		oidcProvider: oidc.NewProvider(oidc.Config{
+			Issuer:      idp.URL,
+			ClientID:    "tubely",
+			RedirectURL: "http://tubely.test/api/oidc/callback",
+			HTTPClient:  idp.Client(),
+		}),
+	}
+	return cfg, idp
+}
+
+// oidcLogin is a login started in a browser.
+type oidcLogin struct {
+	// query is what the callback is redirected back with
+	query url.Values
+	// cookies are the ones the login endpoint set in the browser
+	cookies []*http.Cookie
+}
+
+// startOIDCLogin runs the login endpoint and the provider.
+func startOIDCLogin(t *testing.T, cfg *apiConfig, idp *oidctest.Server) oidcLogin {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	cfg.handlerOIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login returned %d: %s", rec.Code, rec.Body)
+	}
+	redirect, err := idp.Authorize(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oidcLogin{query: redirect.Query(), cookies: rec.Result().Cookies()}
+}
+
+func finishOIDCLogin(cfg *apiConfig, login oidcLogin) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/oidc/callback", nil)
+	req.URL.RawQuery = login.query.Encode()
+	for _, cookie := range login.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	cfg.handlerOIDCCallback(rec, req)
+	return rec
+}
+
+// exchangeOIDCCode follows a successful callback's redirect to the app and
+// swaps the code in it for a session.
+func exchangeOIDCCode(t *testing.T, cfg *apiConfig, callback *httptest.ResponseRecorder) *httptest.ResponseRecorder {
+	t.Helper()
+	if callback.Code != http.StatusFound {
+		t.Fatalf("callback returned %d: %s", callback.Code, callback.Body)
+	}
+	location, err := url.Parse(callback.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := location.Query().Get("oidc_code")
+	if location.Path != "/app/" || code == "" {
+		t.Fatalf("callback redirected to %s, want the app with a login code", location)
+	}
+	body, err := json.Marshal(map[string]string{"code": code})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	cfg.handlerOIDCExchange(rec, httptest.NewRequest(http.MethodPost, "/api/oidc/exchange", strings.NewReader(string(body))))
+	return rec
+}
+
+func TestOIDCCallbackSignsIn(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+
+	rec := exchangeOIDCCode(t, cfg, finishOIDCLogin(cfg, startOIDCLogin(t, cfg, idp)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("exchange returned %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Email != "user@example.com" || body.Token == "" {
+		t.Fatalf("exchange response = %+v, want a session for user@example.com", body)
+	}
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+
+	login := startOIDCLogin(t, cfg, idp)
+	login.query.Set("state", "forged-state")
+	rec := finishOIDCLogin(cfg, login)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback with a bad state returned %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsOtherBrowser(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+
+	// the victim's browser has a login of its own going, but not the one
+	// the state and code are from
+	login := startOIDCLogin(t, cfg, idp)
+	login.cookies = startOIDCLogin(t, cfg, idp).cookies
+	rec := finishOIDCLogin(cfg, login)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback in another browser returned %d, want 400", rec.Code)
+	}
+
+	login.cookies = nil
+	rec = finishOIDCLogin(cfg, login)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("callback without the state cookie returned %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsReusedState(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+
+	login := startOIDCLogin(t, cfg, idp)
+	if rec := finishOIDCLogin(cfg, login); rec.Code != http.StatusFound {
+		t.Fatalf("first callback returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := finishOIDCLogin(cfg, login); rec.Code != http.StatusBadRequest {
+		t.Fatalf("replayed callback returned %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCExchangeRejectsReusedCode(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+
+	callback := finishOIDCLogin(cfg, startOIDCLogin(t, cfg, idp))
+	if rec := exchangeOIDCCode(t, cfg, callback); rec.Code != http.StatusOK {
+		t.Fatalf("first exchange returned %d: %s", rec.Code, rec.Body)
+	}
+	if rec := exchangeOIDCCode(t, cfg, callback); rec.Code != http.StatusBadRequest {
+		t.Fatalf("second exchange returned %d, want 400", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRejectsBadNonce(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+	idp.SetNonce("replayed-nonce")
+
+	rec := finishOIDCLogin(cfg, startOIDCLogin(t, cfg, idp))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("callback with a bad nonce returned %d, want 401", rec.Code)
+	}
+}
+
+func TestOIDCCallbackRequiresSecondFactor(t *testing.T) {
+	cfg, idp := newOIDCTestConfig(t)
+	ctx := context.Background()
+
+	// an existing account with TOTP, which the identity gets linked to by
+	// its verified email
+	user, err := cfg.db.CreateUser(ctx, database.CreateUserParams{Email: "user@example.com", Password: "unused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.SetPendingUserTOTP(ctx, user.ID, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.EnableUserTOTP(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := exchangeOIDCCode(t, cfg, finishOIDCLogin(cfg, startOIDCLogin(t, cfg, idp)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("exchange returned %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if !body.MFARequired || body.MFAToken == "" || body.Token != "" {
+		t.Fatalf("exchange response = %+v, want an MFA challenge and no session", body)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerPasswordForgot(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(r.Context(), params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get user", err)
+		return
+	}
+
+	// always answer the same way, and as quickly, so the endpoint can't be
+	// used to find out which emails have accounts. Creating the token and
+	// sending the email would otherwise make the response slower for them.
+	if user.ID != uuid.Nil {
+		ctx := context.WithoutCancel(r.Context())
+		cfg.goBackground(func() {
+			err := cfg.sendPasswordResetEmail(ctx, user)
+			if err != nil {
+				slog.ErrorContext(ctx, "Couldn't send password reset email", "user_id", user.ID, "error", err)
+			}
+		})
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) handlerPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Token == "" || params.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Token and password are required", nil)
+		return
+	}
+
+	userID, err := cfg.db.ConsumeUserToken(r.Context(), auth.HashToken(params.Token), database.UserTokenPurposePasswordReset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check reset token", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid or expired reset token", nil)
+		return
+	}
+
+	hashedPassword, err := auth.HashPassword(params.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		return
+	}
+
+	err = cfg.db.UpdateUserPassword(r.Context(), userID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update password", err)
+		return
+	}
+
+	// following the emailed link proves the user owns the address
+	err = cfg.db.MarkUserEmailVerified(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't verify email", err)
+		return
+	}
+
+	err = cfg.db.InvalidateUserTokens(r.Context(), userID, database.UserTokenPurposePasswordReset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't invalidate reset tokens", err)
+		return
+	}
+
+	err = cfg.db.RevokeUserRefreshTokens(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke sessions", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
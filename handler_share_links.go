@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const sharePlaybackURLTTL = time.Hour
+
+// maxShareLinkTTL is the longest a share link can be set to expire in.
+const maxShareLinkTTL = 365 * 24 * time.Hour
+
+// shareLinkResponse is a share link as returned when it's created. Only the
+// token's hash is stored, so the link's URL can't be shown again later.
+type shareLinkResponse struct {
+	database.ShareLink
+	URL string `json:"url"`
+}
+
+// getOwnedVideo authenticates the request and loads the video in the
+// videoID path value, responding with an error unless the caller owns it.
+func (cfg *apiConfig) getOwnedVideo(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You don't own this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) handlerShareLinkCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		ExpiresInSeconds *int    `json:"expires_in_seconds"`
+		Password         *string `json:"password"`
+		MaxViews         *int    `json:"max_views"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	createParams := database.CreateShareLinkParams{
+		VideoID:  video.ID,
+		UserID:   video.UserID,
+		MaxViews: params.MaxViews,
+	}
+
+	if params.ExpiresInSeconds != nil {
+		if *params.ExpiresInSeconds <= 0 {
+			respondWithError(w, http.StatusBadRequest, "expires_in_seconds must be positive", nil)
+			return
+		}
+		if *params.ExpiresInSeconds > int(maxShareLinkTTL/time.Second) {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("expires_in_seconds can't be more than %d", int(maxShareLinkTTL/time.Second)), nil)
+			return
+		}
+		expiresAt := time.Now().UTC().Add(time.Duration(*params.ExpiresInSeconds) * time.Second)
+		createParams.ExpiresAt = &expiresAt
+	}
+	if params.MaxViews != nil && *params.MaxViews <= 0 {
+		respondWithError(w, http.StatusBadRequest, "max_views must be positive", nil)
+		return
+	}
+	if params.Password != nil && *params.Password != "" {
+		hash, err := auth.HashPassword(*params.Password)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+			return
+		}
+		createParams.PasswordHash = &hash
+	}
+
+	shareToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share token", err)
+		return
+	}
+	createParams.TokenHash = auth.HashToken(shareToken)
+
+	link, err := cfg.db.CreateShareLink(r.Context(), createParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create share link", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, shareLinkResponse{
+		ShareLink: link,
+		URL:       fmt.Sprintf("%s/api/shares/%s", cfg.publicBaseURL, shareToken),
+	})
+}
+
+func (cfg *apiConfig) handlerShareLinksRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	links, err := cfg.db.GetShareLinks(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve share links", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, links)
+}
+
+func (cfg *apiConfig) handlerShareLinkRevoke(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	shareID, err := uuid.Parse(r.PathValue("shareID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid share ID", err)
+		return
+	}
+
+	link, err := cfg.db.GetShareLink(r.Context(), shareID)
+	if err != nil || link.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get share link", err)
+		return
+	}
+
+	err = cfg.db.RevokeShareLink(r.Context(), link.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke share link", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerShareLinkResolve is public. It checks a share token and returns the
+// video with a freshly presigned playback URL. Password protected links need
+// the password in the X-Share-Password header.
+func (cfg *apiConfig) handlerShareLinkResolve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Title           string    `json:"title"`
+		Description     string    `json:"description"`
+		ThumbnailURL    *string   `json:"thumbnail_url"`
+		VideoURL        *string   `json:"video_url"`
+		VideoURLExpires time.Time `json:"video_url_expires_at"`
+	}
+
+	link, err := cfg.db.GetShareLinkByTokenHash(r.Context(), auth.HashToken(r.PathValue("token")))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get share link", err)
+		return
+	}
+	now := time.Now().UTC()
+	if link.ID == uuid.Nil || link.RevokedAt != nil || (link.ExpiresAt != nil && !now.Before(*link.ExpiresAt)) {
+		respondWithError(w, http.StatusNotFound, "Share link not found or expired", nil)
+		return
+	}
+
+	if link.PasswordHash != nil {
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			respondWithError(w, http.StatusUnauthorized, "This share link needs a password", nil)
+			return
+		}
+		if err := auth.CheckPasswordHash(password, *link.PasswordHash); err != nil {
+			respondWithError(w, http.StatusUnauthorized, "Incorrect password", err)
+			return
+		}
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), link.VideoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	ok, err := cfg.db.RecordShareLinkView(r.Context(), link.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't record view", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusGone, "Share link has reached its view limit", nil)
+		return
+	}
+
+	// the playback URL shouldn't outlive the link itself
+	ttl := sharePlaybackURLTTL
+	if link.ExpiresAt != nil {
+		ttl = max(min(ttl, link.ExpiresAt.Sub(now)), time.Minute)
+	}
+
+	if video.VideoURL != nil && *video.VideoURL != "" {
+		presignedURL, err := cfg.presignVideoURL(*video.VideoURL, ttl)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+		video.VideoURL = &presignedURL
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, response{
+		Title:           video.Title,
+		Description:     video.Description,
+		ThumbnailURL:    video.ThumbnailURL,
+		VideoURL:        video.VideoURL,
+		VideoURLExpires: now.Add(ttl),
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime"
 	"net/http"
 	"os"
@@ -11,6 +12,8 @@ import (
 	"strings"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
 	"github.com/google/uuid"
 )
 
@@ -28,13 +31,13 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
+	slog.InfoContext(r.Context(), "Uploading thumbnail", "video_id", videoID, "user_id", userID)
 
 	const maxMemory int64 = 10 << 20
 
@@ -44,6 +47,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusBadRequest, "unable to parse form file", err)
 		return
 	}
+	metrics.ObserveUpload("thumbnail", header.Size)
 
 	headers := header.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(headers)
@@ -63,7 +67,7 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "couldn't get video", err)
 		return
@@ -84,12 +88,19 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	thumbnailUrl := fmt.Sprintf("http://localhost:8091/%s", filePath)
 	video.ThumbnailURL = &thumbnailUrl
-	err = cfg.db.UpdateVideo(video)
+	err = cfg.db.UpdateVideo(r.Context(), video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to update video", err)
 		return
 	}
 
+	cfg.events.Publish(r.Context(), events.Event{
+		Type:    events.ThumbnailUpdated,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+
 	respondWithJSON(w, http.StatusOK, video)
 }
 
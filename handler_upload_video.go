@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,6 +14,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,6 +22,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/progress"
 	"github.com/google/uuid"
 )
 
@@ -38,13 +45,13 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "couldn't get video", err)
 		return
@@ -56,65 +63,178 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// reject uploads that can't fit before reading them. The body is a
+	// little bigger than the file because of the multipart framing, which
+	// is close enough here; the exact size is checked once it's read.
+	if r.ContentLength > 0 {
+		ok, err := cfg.checkStorageQuota(r.Context(), userID, r.ContentLength)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
+			return
+		}
+		if !ok {
+			respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", nil)
+			return
+		}
+	}
+
+	// the multipart parser reads the whole body before FormFile returns, so
+	// count bytes as they come off the wire
+	reportReceived := cfg.byteProgress(video, progress.StageReceiving, r.ContentLength)
+	reportReceived(0)
+	received := newProgressReader(r.Body, reportReceived)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{received, r.Body}
+
 	file, header, err := r.FormFile("video")
 	if err != nil {
+		cfg.reportUploadRejected(video, "unable to parse form file")
 		respondWithError(w, http.StatusBadRequest, "unable to parse form file", err)
 		return
 	}
+	reportReceived(received.read)
 	defer file.Close()
+	metrics.ObserveUpload("video", header.Size)
 
 	headers := header.Header.Get("Content-Type")
 	mediaType, _, err := mime.ParseMediaType(headers)
 	if err != nil {
+		cfg.reportUploadRejected(video, "failed to parse content type")
 		respondWithError(w, http.StatusBadRequest, "failed to parse content type", err)
 		return
 	}
 
 	if mediaType != "video/mp4" {
+		cfg.reportUploadRejected(video, "incorrect file type. video must be an mp4")
 		respondWithError(w, http.StatusUnsupportedMediaType, "incorrect file type. video must be an mp4", err)
 		return
 	}
 
+	checksums, err := parseUploadChecksums(http.Header(header.Header), r.Header)
+	if err != nil {
+		cfg.reportUploadRejected(video, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
 	// create temporary local copy of video file
 	tmpVideo, err := os.CreateTemp("", "tubely-upload.mp4")
 	if err != nil {
+		cfg.reportUploadRejected(video, "failed to create temp video file")
 		respondWithError(w, http.StatusInternalServerError, "failed to create temp video file", err)
 		return
 	}
 	defer os.Remove(tmpVideo.Name()) // Remove after closing
 	defer tmpVideo.Close()           // Close first (LIFO)
 
-	// Copy uploaded file to temporary file
-	_, err = io.Copy(tmpVideo, file)
+	// Copy uploaded file to temporary file, hashing it on the way so
+	// identical uploads can share one stored blob and any checksums the
+	// client sent can be verified
+	hasher := sha256.New()
+	writers := append([]io.Writer{tmpVideo, hasher}, checksumWriters(checksums)...)
+	_, err = io.Copy(io.MultiWriter(writers...), file)
 	if err != nil {
+		cfg.reportUploadRejected(video, "failed to write content to video file")
 		respondWithError(w, http.StatusInternalServerError, "failed to write content to video file", err)
 		return
 	}
+	for _, checksum := range checksums {
+		if err := checksum.verify(); err != nil {
+			cfg.reportUploadRejected(video, "checksum mismatch, the file was corrupted in transit")
+			respondWithError(w, http.StatusBadRequest, "checksum mismatch, the file was corrupted in transit", err)
+			return
+		}
+	}
+	contentHash := hex.EncodeToString(hasher.Sum(nil))
 
-	_, err = tmpVideo.Seek(0, io.SeekStart)
+	ok, err := cfg.checkStorageQuota(r.Context(), userID, header.Size)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not reset file pointer", err)
+		cfg.reportUploadRejected(video, "Couldn't check quota")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
+		return
+	}
+	if !ok {
+		cfg.reportUploadRejected(video, "Storage quota exceeded")
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Storage quota exceeded", nil)
 		return
 	}
 
-	// get aspect ratio
-	aspectRatio, err := getVideoAspectRatio(tmpVideo.Name())
+	cfg.events.Publish(r.Context(), events.Event{
+		Type:    events.VideoUploaded,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+
+	// if the same file is already stored, reference it rather than
+	// processing and storing it again
+	_, reused, err := cfg.db.CreateVideoVersionFromBlob(r.Context(), video.ID, contentHash, userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "unable to determine video aspect ratio", err)
+		cfg.publishVideoFailed(r.Context(), video, "Couldn't update video")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+	if !reused {
+		params, message, err := cfg.processUpload(r.Context(), video, tmpVideo.Name(), mediaType, contentHash)
+		if err != nil {
+			cfg.publishVideoFailed(r.Context(), video, message)
+			respondWithError(w, http.StatusInternalServerError, message, err)
+			return
+		}
+		params.UploadedBy = userID
+
+		// record the upload as a new version, which points the video's url
+		// at the new s3 location
+		_, err = cfg.db.CreateVideoVersion(r.Context(), params)
+		if err != nil {
+			cfg.publishVideoFailed(r.Context(), video, "Couldn't update video")
+			respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+			return
+		}
+	}
+
+	video, err = cfg.db.GetVideo(r.Context(), video.ID)
+	if err != nil {
+		cfg.publishVideoFailed(r.Context(), video, "Couldn't update video")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
 		return
 	}
+	cfg.pruneVideoVersions(r.Context(), video)
 
-	// determine the correct prefix
-	var prefix string
-	if aspectRatio == "16:9" {
-		prefix = "landscape/"
-	} else if aspectRatio == "9:16" {
-		prefix = "portrait/"
-	} else {
-		prefix = "other/"
+	cfg.reportProgress(video, progress.StageDone, 100)
+	cfg.events.Publish(r.Context(), events.Event{
+		Type:    events.VideoProcessed,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "failed to create signed url", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, video)
+}
+
+// processUpload probes an uploaded file, processes it for streaming and
+// stores it under a key derived from its hash. On failure it returns the
+// message for the uploader along with the error.
+func (cfg *apiConfig) processUpload(ctx context.Context, video database.Video, filePath, mediaType, contentHash string) (database.CreateVideoVersionParams, string, error) {
+	// get aspect ratio and duration
+	cfg.reportProgress(video, progress.StageProbing, -1)
+	probe, err := probeVideo(ctx, filePath)
+	if err != nil {
+		return database.CreateVideoVersionParams{}, "unable to determine video aspect ratio", err
 	}
+	cfg.reportProgress(video, progress.StageProbing, 100)
 
-	switch aspectRatio {
+	// determine the correct prefix
+	var prefix string
+	switch probe.AspectRatio {
 	case "16:9":
 		prefix = "landscape"
 	case "9:16":
@@ -123,69 +243,111 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 		prefix = "other"
 	}
 
-	// Create a unique key for S3
-	assetPath := getAssetPath(mediaType)
-	key := filepath.Join(prefix, assetPath)
+	// the key is derived from the content, so identical uploads share it
+	key := filepath.Join(prefix, getContentAddressedPath(contentHash, mediaType))
 
 	// create a processed video with the moov atom at the front
-	processedVideoPath, err := processVideoForFastStart(tmpVideo.Name())
+	cfg.reportProgress(video, progress.StageProcessing, 0)
+	processedVideoPath, err := processVideoForFastStart(ctx, filePath, probe.Duration, func(percent float64) {
+		cfg.reportProgress(video, progress.StageProcessing, percent)
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to process video for fast start", err)
-		return
+		return database.CreateVideoVersionParams{}, "failed to process video for fast start", err
 	}
 	defer os.Remove(processedVideoPath)
 
 	processedVideo, err := os.Open(processedVideoPath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "unable to open processed video", err)
-		return
+		return database.CreateVideoVersionParams{}, "unable to open processed video", err
 	}
 	defer processedVideo.Close()
 
-	// Set up the S3 input parameters and upload the asset
-	_, err = cfg.s3Client.PutObject(r.Context(), &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(key),
-		Body:        processedVideo,
-		ContentType: aws.String(mediaType),
-	})
+	processedInfo, err := processedVideo.Stat()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Error uploading file to S3", err)
-		return
+		return database.CreateVideoVersionParams{}, "unable to open processed video", err
 	}
 
-	// create the new video url to point to s3 location
-	url := fmt.Sprintf("%s,%s", cfg.s3Bucket, key)
-	video.VideoURL = &url
-	err = cfg.db.UpdateVideo(video)
+	// S3 rejects the upload if what it receives doesn't match
+	checksum, err := fileSHA256(processedVideo)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
-		return
+		return database.CreateVideoVersionParams{}, "unable to read processed video", err
 	}
-	video, err = cfg.dbVideoToSignedVideo(video)
+
+	// Set up the S3 input parameters and upload the asset
+	_, err = cfg.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:         aws.String(cfg.s3Bucket),
+		Key:            aws.String(key),
+		Body:           newProgressReadSeeker(processedVideo, cfg.byteProgress(video, progress.StageStoring, processedInfo.Size())),
+		ContentType:    aws.String(mediaType),
+		ChecksumSHA256: aws.String(checksum),
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "failed to create signed url", err)
-		return
-	}
+		return database.CreateVideoVersionParams{}, "Error uploading file to S3", err
+	}
+
+	return database.CreateVideoVersionParams{
+		VideoID:         video.ID,
+		Bucket:          cfg.s3Bucket,
+		Key:             key,
+		ContentType:     mediaType,
+		SizeBytes:       processedInfo.Size(),
+		AspectRatio:     probe.AspectRatio,
+		DurationSeconds: probe.Duration.Seconds(),
+		SHA256:          contentHash,
+		ChecksumSHA256:  checksum,
+	}, "", nil
+}
 
-	respondWithJSON(w, http.StatusCreated, video)
+// reportUploadRejected tells progress streams that an upload was rejected
+// before processing started, with the same message the uploader gets back.
+// Nothing happened to the video, so unlike publishVideoFailed there's no
+// event for it.
+func (cfg *apiConfig) reportUploadRejected(video database.Video, message string) {
+	cfg.progress.Publish(video.ID, progress.Update{
+		Stage:   progress.StageFailed,
+		Percent: -1,
+		Error:   message,
+	})
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
+// publishVideoFailed tells subscribers and progress streams that processing
+// an uploaded video failed, with the same message the uploader gets back.
+func (cfg *apiConfig) publishVideoFailed(ctx context.Context, video database.Video, message string) {
+	cfg.reportUploadRejected(video, message)
+	cfg.events.Publish(ctx, events.Event{
+		Type:    events.VideoFailed,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    map[string]string{"error": message},
+	})
+}
+
+type videoProbe struct {
+	AspectRatio string
+	Duration    time.Duration
+}
+
+func probeVideo(ctx context.Context, filePath string) (videoProbe, error) {
 	type Stream struct {
 		Width  int `json:"width,omitempty"`
 		Height int `json:"height,omitempty"`
 	}
 
+	type Format struct {
+		Duration string `json:"duration,omitempty"`
+	}
+
 	type FFProbeOutput struct {
 		Streams []Stream `json:"streams"`
+		Format  Format   `json:"format"`
 	}
 
 	// create command to get video info
-	cmd := exec.Command("ffprobe",
+	cmd := exec.CommandContext(ctx, "ffprobe",
 		"-v", "error",
 		"-print_format", "json",
 		"-show_streams",
+		"-show_format",
 		filePath,
 	)
 
@@ -194,47 +356,71 @@ func getVideoAspectRatio(filePath string) (string, error) {
 	cmd.Stdout = &out
 
 	// run the command
+	done := startMediaCommand(ctx, cmd)
 	err := cmd.Run()
+	done(err)
 	if err != nil {
-		return "", fmt.Errorf("unable to get video data %v", err)
+		return videoProbe{}, fmt.Errorf("unable to get video data %v", err)
 	}
 
 	// unmarshal the output
 	var result FFProbeOutput
 	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
-		return "", fmt.Errorf("error parsing video data %v", err)
+		return videoProbe{}, fmt.Errorf("error parsing video data %v", err)
 	}
 
 	if len(result.Streams) == 0 {
-		return "", fmt.Errorf("no streams found in ffprobe output")
+		return videoProbe{}, fmt.Errorf("no streams found in ffprobe output")
 	}
 
 	// get width and height of the video
 	width := result.Streams[0].Width
 	height := result.Streams[0].Height
 
-	// determine the aspect ratio
-	aspectRatio := getAspectCategory(width, height)
+	// the duration is only used for progress, so a missing one isn't an error
+	var duration time.Duration
+	if seconds, err := strconv.ParseFloat(result.Format.Duration, 64); err == nil {
+		duration = time.Duration(seconds * float64(time.Second))
+	}
 
-	return aspectRatio, nil
+	return videoProbe{
+		AspectRatio: getAspectCategory(width, height),
+		Duration:    duration,
+	}, nil
 }
 
 // configure an uploaded video for faststart/streaming
-// returns the path to the
-func processVideoForFastStart(filePath string) (string, error) {
+// returns the path to the processed file. onProgress is called with the
+// percentage done as ffmpeg reports it, if the duration is known
+func processVideoForFastStart(ctx context.Context, filePath string, duration time.Duration, onProgress func(percent float64)) (string, error) {
 	outputPath := filePath + ".processing"
-	cmd := exec.Command(
-		"ffmpeg", "-i",
+	cmd := exec.CommandContext(
+		ctx, "ffmpeg", "-i",
 		filePath, "-c",
 		"copy", "-movflags",
 		"faststart", "-f",
-		"mp4", outputPath,
+		"mp4", "-progress",
+		"pipe:1", "-nostats",
+		outputPath,
 	)
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("error processing video: %v", err)
+	}
+	done := startMediaCommand(ctx, cmd)
+	if err := cmd.Start(); err != nil {
+		done(err)
+		return "", fmt.Errorf("error processing video: %v", err)
+	}
+	readFFmpegProgress(stdout, duration, onProgress)
+
+	err = cmd.Wait()
+	done(err)
+	if err != nil {
 		return "", fmt.Errorf("error processing video: %s, %v", stderr.String(), err)
 	}
 
@@ -251,6 +437,35 @@ func processVideoForFastStart(filePath string) (string, error) {
 	return outputPath, nil
 }
 
+// readFFmpegProgress parses the key=value blocks ffmpeg writes with
+// -progress until the output is closed. Each block ends with a progress=
+// line, and out_time_us is how far into the input it has got.
+func readFFmpegProgress(r io.Reader, duration time.Duration, onProgress func(percent float64)) {
+	scanner := bufio.NewScanner(r)
+	var outTime time.Duration
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_us":
+			if us, err := strconv.ParseInt(value, 10, 64); err == nil {
+				outTime = time.Duration(us) * time.Microsecond
+			}
+		case "progress":
+			switch {
+			case value == "end":
+				onProgress(100)
+			case duration > 0:
+				onProgress(min(100, max(0, float64(outTime)*100/float64(duration))))
+			}
+		}
+	}
+	// drain anything left so ffmpeg never blocks writing to the pipe
+	io.Copy(io.Discard, r)
+}
+
 func getAspectCategory(width, height int) string {
 	if width == 0 || height == 0 {
 		return "invalid"
@@ -283,6 +498,7 @@ func generatePresignedURL(s3Client *s3.Client, bucket, key string, expireTime ti
 	if err != nil {
 		return "", fmt.Errorf("failed to generate presigned URL: %v", err)
 	}
+	metrics.IncPresignedURLs()
 
 	return presignedObject.URL, nil
 }
@@ -291,13 +507,7 @@ func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video
 	if video.VideoURL == nil || *video.VideoURL == "" {
 		return video, nil
 	}
-	// Split the video URL into bucket and key
-	urlParts := strings.Split(*video.VideoURL, ",")
-	if len(urlParts) != 2 {
-		return video, nil
-	}
-	bucket, key := urlParts[0], urlParts[1]
-	presignedUrl, err := generatePresignedURL(cfg.s3Client, bucket, key, time.Hour)
+	presignedUrl, err := cfg.presignVideoURL(*video.VideoURL, time.Hour)
 	if err != nil {
 		return video, err
 	}
@@ -305,6 +515,18 @@ func (cfg *apiConfig) dbVideoToSignedVideo(video database.Video) (database.Video
 	return video, nil
 }
 
+// presignVideoURL turns a stored "bucket,key" video URL into a presigned
+// playback URL. Values in any other format are returned unchanged.
+func (cfg *apiConfig) presignVideoURL(videoURL string, expireTime time.Duration) (string, error) {
+	// Split the video URL into bucket and key
+	urlParts := strings.Split(videoURL, ",")
+	if len(urlParts) != 2 {
+		return videoURL, nil
+	}
+	bucket, key := urlParts[0], urlParts[1]
+	return generatePresignedURL(cfg.s3Client, bucket, key, expireTime)
+}
+
 func abs(x float64) float64 {
 	if x < 0 {
 		return -x
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
 	"github.com/google/uuid"
 )
 
@@ -19,7 +27,7 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
@@ -34,12 +42,42 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	}
 	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	if params.Visibility == "" {
+		params.Visibility = database.VisibilityPrivate
+	}
+	if !params.Visibility.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public", nil)
+		return
+	}
+	params.PublishAt, params.UnpublishAt, err = validatePublishWindow(params.PublishAt, params.UnpublishAt)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	ok, err := cfg.checkVideoQuota(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't check quota", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusForbidden, "Video quota exceeded, delete a video to create another", nil)
+		return
+	}
+
+	video, err := cfg.db.CreateVideo(r.Context(), params.CreateVideoParams)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
 		return
 	}
 
+	cfg.events.Publish(r.Context(), events.Event{
+		Type:    events.VideoCreated,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+
 	respondWithJSON(w, http.StatusCreated, video)
 }
 
@@ -56,13 +94,13 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
 	if err != nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
@@ -72,7 +110,7 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.deleteVideo(r.Context(), video)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
 		return
@@ -81,6 +119,39 @@ func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteVideo deletes a video's thumbnail and records along with any stored
+// files no other video uses.
+func (cfg *apiConfig) deleteVideo(ctx context.Context, video database.Video) error {
+	// the thumbnail goes first, so if it can't be deleted the video is still
+	// there to try again with
+	if thumbnailPath, ok := cfg.thumbnailPath(video); ok {
+		err := os.Remove(thumbnailPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("couldn't delete thumbnail: %w", err)
+		}
+	}
+
+	orphans, err := cfg.db.DeleteVideo(ctx, video.ID)
+	if err != nil {
+		return err
+	}
+
+	// the records are gone, so leftover objects can only be logged
+	for _, object := range orphans {
+		if err := cfg.deleteOrphanedVideoObject(ctx, object); err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete object from storage", "key", object.Key, "error", err)
+		}
+	}
+
+	cfg.events.Publish(ctx, events.Event{
+		Type:    events.VideoDeleted,
+		UserID:  video.UserID,
+		VideoID: video.ID,
+		Data:    newVideoEventData(video),
+	})
+	return nil
+}
+
 func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
@@ -89,11 +160,95 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	if !cfg.canViewVideo(r, video) {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// canViewVideo reports whether the requester may see a video. Private videos,
+// including ones outside their publishing window, are only visible to their
+// owner, everything else to anyone with the ID.
+func (cfg *apiConfig) canViewVideo(r *http.Request, video database.Video) bool {
+	if video.EffectiveVisibility(time.Now().UTC()) != database.VisibilityPrivate {
+		return true
+	}
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		return false
+	}
+	return userID == video.UserID
+}
+
+func (cfg *apiConfig) handlerVideoVisibilityUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Visibility database.Visibility `json:"visibility"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
 	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Visibility.Valid() {
+		respondWithError(w, http.StatusBadRequest, "Visibility must be private, unlisted or public", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if err != nil || video.ID == uuid.Nil {
 		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
 		return
 	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, "You can't change this video", nil)
+		return
+	}
+
+	video.Visibility = params.Visibility
+	err = cfg.db.UpdateVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
 
 	video, err = cfg.dbVideoToSignedVideo(video)
 	if err != nil {
@@ -104,19 +259,119 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, video)
 }
 
+func (cfg *apiConfig) handlerVideoScheduleUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PublishAt   *time.Time `json:"publish_at"`
+		UnpublishAt *time.Time `json:"unpublish_at"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video.PublishAt, video.UnpublishAt, err = validatePublishWindow(params.PublishAt, params.UnpublishAt)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't update video", err)
+		return
+	}
+
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// validatePublishWindow normalizes the publishing window to UTC, which the
+// database relies on when comparing times, and checks it's in order.
+func validatePublishWindow(publishAt, unpublishAt *time.Time) (*time.Time, *time.Time, error) {
+	if publishAt != nil {
+		t := publishAt.UTC()
+		publishAt = &t
+	}
+	if unpublishAt != nil {
+		t := unpublishAt.UTC()
+		unpublishAt = &t
+	}
+	if publishAt != nil && unpublishAt != nil && !unpublishAt.After(*publishAt) {
+		return nil, nil, errors.New("unpublish_at must be after publish_at")
+	}
+	return publishAt, unpublishAt, nil
+}
+
+func (cfg *apiConfig) handlerPublicVideosRetrieve(w http.ResponseWriter, r *http.Request) {
+	const (
+		defaultLimit = 20
+		maxLimit     = 100
+	)
+
+	limit := defaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid limit", err)
+			return
+		}
+		limit = min(n, maxLimit)
+	}
+	offset := 0
+	if s := r.URL.Query().Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid offset", err)
+			return
+		}
+		offset = n
+	}
+
+	videos, err := cfg.db.GetPublicVideos(r.Context(), limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		return
+	}
+
+	for i, video := range videos {
+		video, err = cfg.dbVideoToSignedVideo(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+			return
+		}
+		videos[i] = video
+	}
+
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
 		return
 	}
-	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
 		return
 	}
 
-	videos, err := cfg.db.GetVideos(userID)
+	videos, err := cfg.db.GetVideos(r.Context(), userID)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
 		return
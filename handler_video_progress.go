@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/progress"
+	"github.com/google/uuid"
+)
+
+const (
+	progressHeartbeatInterval = 15 * time.Second
+	progressReportInterval    = 250 * time.Millisecond
+)
+
+// handlerVideoProgress streams upload and processing progress for a video as
+// Server-Sent Events. EventSource can't send headers, so like the stream
+// endpoint it also takes a media token in the token query parameter.
+func (cfg *apiConfig) handlerVideoProgress(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return
+	}
+
+	userID, ok := cfg.streamViewerID(w, r, videoID)
+	if !ok {
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if err != nil || video.ID == uuid.Nil || video.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stop reverse proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	last, updates, cancel := cfg.progress.Subscribe(video.ID)
+	defer cancel()
+
+	if _, err := io.WriteString(w, ": connected\n\n"); err != nil {
+		return
+	}
+	if last != nil {
+		if err := writeProgressEvent(w, *last); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(progressHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-cfg.shutdown:
+			return
+		case u := <-updates:
+			if err := writeProgressEvent(w, u); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeProgressEvent(w io.Writer, u progress.Update) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+	return err
+}
+
+// reportProgress publishes a progress update for the video.
+func (cfg *apiConfig) reportProgress(video database.Video, stage progress.Stage, percent float64) {
+	cfg.progress.Publish(video.ID, progress.Update{
+		Stage:   stage,
+		Percent: percent,
+	})
+}
+
+// byteProgress returns a callback that publishes byte counts for a stage.
+// total may be unknown (<= 0), in which case the percentage is -1.
+func (cfg *apiConfig) byteProgress(video database.Video, stage progress.Stage, total int64) func(n int64) {
+	return func(n int64) {
+		percent := -1.0
+		if total > 0 {
+			percent = min(100, float64(n)*100/float64(total))
+		}
+		cfg.progress.Publish(video.ID, progress.Update{
+			Stage:      stage,
+			Percent:    percent,
+			Bytes:      n,
+			TotalBytes: max(total, 0),
+		})
+	}
+}
+
+// progressReader counts the bytes read through it and reports the count at
+// most every progressReportInterval, and again at EOF.
+type progressReader struct {
+	r          io.Reader
+	read       int64
+	report     func(n int64)
+	lastReport time.Time
+}
+
+func newProgressReader(r io.Reader, report func(n int64)) *progressReader {
+	return &progressReader{r: r, report: report}
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if err == io.EOF || time.Since(p.lastReport) >= progressReportInterval {
+		p.lastReport = time.Now()
+		p.report(p.read)
+	}
+	return n, err
+}
+
+// progressReadSeeker is a progressReader over a seekable body, which the S3
+// client needs to work out the length and to retry requests. Seeking moves
+// the count, so a rewind for a retry starts the progress over.
+type progressReadSeeker struct {
+	*progressReader
+	s io.Seeker
+}
+
+func newProgressReadSeeker(rs io.ReadSeeker, report func(n int64)) *progressReadSeeker {
+	return &progressReadSeeker{
+		progressReader: newProgressReader(rs, report),
+		s:              rs,
+	}
+}
+
+func (p *progressReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := p.s.Seek(offset, whence)
+	if err == nil {
+		p.read = pos
+	}
+	return pos, err
+}
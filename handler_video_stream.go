@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerVideoStream proxies the video file from storage so the bucket is
+// never exposed to the browser. http.ServeContent takes care of Range,
+// If-Range, If-None-Match and 206/304/416 responses.
+func (cfg *apiConfig) handlerVideoStream(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(r.Context(), videoID)
+	if err != nil || video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		return
+	}
+
+	viewerID, ok := cfg.streamViewerID(w, r, video.ID)
+	if !ok {
+		return
+	}
+	if video.EffectiveVisibility(time.Now().UTC()) == database.VisibilityPrivate && viewerID != video.UserID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, "Video has not been uploaded", nil)
+		return
+	}
+	bucket, key, ok := strings.Cut(*video.VideoURL, ",")
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Video is not stored in this bucket", nil)
+		return
+	}
+
+	head, err := cfg.s3Client.HeadObject(r.Context(), &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, "Couldn't get video from storage", err)
+		return
+	}
+
+	etag := aws.ToString(head.ETag)
+	size := aws.ToInt64(head.ContentLength)
+	modTime := aws.ToTime(head.LastModified)
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", cfg.videoContentType(r.Context(), video, aws.ToString(head.ContentType)))
+	w.Header().Set("Cache-Control", "private, max-age=0, must-revalidate")
+
+	body := newS3ObjectReader(r.Context(), cfg.s3Client, bucket, key, etag, size)
+	defer body.Close()
+
+	counter := &countingResponseWriter{ResponseWriter: w}
+	start := time.Now()
+	http.ServeContent(counter, r, "", modTime, body)
+
+	slog.InfoContext(r.Context(), "Streamed video",
+		"video_id", video.ID,
+		"viewer", viewerIDString(viewerID),
+		"range", r.Header.Get("Range"),
+		"bytes", counter.bytes,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+// videoContentType returns the content type storage reported for a video's
+// file, or the one recorded for its current version if storage didn't
+// report one.
+func (cfg *apiConfig) videoContentType(ctx context.Context, video database.Video, stored string) string {
+	if stored != "" {
+		return stored
+	}
+	if video.CurrentVersionID != nil {
+		version, err := cfg.db.GetVideoVersion(ctx, *video.CurrentVersionID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't get video version", "video_id", video.ID, "error", err)
+		} else if version.ContentType != nil && *version.ContentType != "" {
+			return *version.ContentType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// mediaTokenTTL is how long a media token works for, long enough to watch a
+// video or follow an upload in one sitting.
+const mediaTokenTTL = 2 * time.Hour
+
+// handlerVideoMediaToken issues the owner of a video a media token for it.
+// <video> and EventSource can't send an Authorization header, and the access
+// token shouldn't go in URLs where it ends up in logs and browser history, so
+// the stream and progress endpoints take this token in the token query
+// parameter instead.
+func (cfg *apiConfig) handlerVideoMediaToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	expiresAt := time.Now().UTC().Add(mediaTokenTTL)
+	token, err := auth.MakeMediaToken(video.UserID, video.ID, cfg.jwtKeys, mediaTokenTTL)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create media token", err)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, response{
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// streamViewerID identifies the viewer of a video from the Authorization
+// header or a media token for the video in the token query parameter. The
+// viewer is uuid.Nil if there's no valid token. It returns false if it
+// responded with an error because the token's user is blocked.
+func (cfg *apiConfig) streamViewerID(w http.ResponseWriter, r *http.Request, videoID uuid.UUID) (uuid.UUID, bool) {
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		// the account status middleware has checked access tokens already
+		userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+		if err != nil {
+			return uuid.Nil, true
+		}
+		return userID, true
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return uuid.Nil, true
+	}
+	claims, err := auth.ValidateMediaToken(token, videoID, cfg.jwtKeys)
+	if err != nil {
+		return uuid.Nil, true
+	}
+	if cfg.respondIfTokenBlocked(r.Context(), w, claims) {
+		return uuid.Nil, false
+	}
+	setRequestUser(r.Context(), claims.UserID)
+	return claims.UserID, true
+}
+
+func viewerIDString(id uuid.UUID) string {
+	if id == uuid.Nil {
+		return "anonymous"
+	}
+	return id.String()
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type videoVersionResponse struct {
+	database.VideoVersion
+	Current bool `json:"current"`
+}
+
+func (cfg *apiConfig) handlerVideoVersionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve video versions", err)
+		return
+	}
+
+	response := make([]videoVersionResponse, 0, len(versions))
+	for _, v := range versions {
+		response = append(response, videoVersionResponse{
+			VideoVersion: v,
+			Current:      video.CurrentVersionID != nil && *video.CurrentVersionID == v.ID,
+		})
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) handlerVideoVersionRollback(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.getOwnedVideo(w, r)
+	if !ok {
+		return
+	}
+
+	versionID, err := uuid.Parse(r.PathValue("versionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid version ID", err)
+		return
+	}
+
+	version, err := cfg.db.GetVideoVersion(r.Context(), versionID)
+	if err != nil || version.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get video version", err)
+		return
+	}
+
+	err = cfg.db.SetCurrentVideoVersion(r.Context(), version)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't roll back video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(r.Context(), video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get video", err)
+		return
+	}
+	video, err = cfg.dbVideoToSignedVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't generate presigned URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, video)
+}
+
+// pruneVideoVersions deletes versions beyond the retention limit, oldest
+// first. The current version is always kept, and a file is only deleted from
+// storage once no version of any video uses it.
+func (cfg *apiConfig) pruneVideoVersions(ctx context.Context, video database.Video) {
+	if cfg.videoVersionRetention <= 0 {
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(ctx, video.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Couldn't get video versions", "video_id", video.ID, "error", err)
+		return
+	}
+
+	for i, v := range versions {
+		if i < cfg.videoVersionRetention {
+			continue
+		}
+		if video.CurrentVersionID != nil && *video.CurrentVersionID == v.ID {
+			continue
+		}
+		orphan, err := cfg.db.DeleteVideoVersion(ctx, v.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete video version", "video_id", video.ID, "version", v.Version, "error", err)
+			continue
+		}
+		if orphan == nil {
+			continue
+		}
+		if err := cfg.deleteOrphanedVideoObject(ctx, *orphan); err != nil {
+			slog.ErrorContext(ctx, "Couldn't delete object from storage", "key", orphan.Key, "error", err)
+		}
+	}
+}
+
+// deleteOrphanedVideoObject deletes a video file whose last reference was
+// released. Keys are derived from the content, so an identical upload may
+// have stored the file again under the same key and recorded a new blob for
+// it after the old one was released. The object is only deleted if nothing
+// references it right before the delete.
+func (cfg *apiConfig) deleteOrphanedVideoObject(ctx context.Context, object database.StorageObject) error {
+	referenced, err := cfg.db.StorageObjectReferenced(ctx, object)
+	if err != nil {
+		return err
+	}
+	if referenced {
+		return nil
+	}
+	return cfg.deleteStorageObject(ctx, object)
+}
+
+func (cfg *apiConfig) deleteStorageObject(ctx context.Context, object database.StorageObject) error {
+	_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(object.Bucket),
+		Key:    aws.String(object.Key),
+	})
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/webhooks"
+	"github.com/google/uuid"
+)
+
+const (
+	webhookDeliveriesDefaultLimit = 50
+	webhookDeliveriesMaxLimit     = 200
+	webhookDispatchInterval       = 5 * time.Second
+)
+
+func (cfg *apiConfig) handlerWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	// the secret is only ever shown in this response
+	type response struct {
+		database.Webhook
+		Secret string `json:"secret"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if err := cfg.validateWebhookURL(r.Context(), params.URL); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error(), err)
+		return
+	}
+	if len(params.Events) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Subscribe to at least one event", nil)
+		return
+	}
+	for _, e := range params.Events {
+		if !events.Type(e).Valid() {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Unknown event %q", e), nil)
+			return
+		}
+	}
+
+	secret, err := webhooks.NewSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook secret", err)
+		return
+	}
+
+	webhook, err := cfg.db.CreateWebhook(r.Context(), database.CreateWebhookParams{
+		UserID: userID,
+		URL:    params.URL,
+		Secret: secret,
+		Events: params.Events,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't create webhook", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		Webhook: webhook,
+		Secret:  secret,
+	})
+}
+
+// validateWebhookURL requires an absolute URL, and outside of dev https and
+// a host that resolves to public addresses only. Deliveries check the
+// address again, this just rejects bad endpoints early.
+func (cfg *apiConfig) validateWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("webhook url must be an absolute URL")
+	}
+	if cfg.platform == "dev" {
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return fmt.Errorf("webhook url must use https")
+		}
+		return nil
+	}
+	if u.Scheme != "https" {
+		return fmt.Errorf("webhook url must use https")
+	}
+	return webhooks.CheckHost(ctx, u.Hostname())
+}
+
+func (cfg *apiConfig) handlerWebhooksRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	hooks, err := cfg.db.GetWebhooks(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve webhooks", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, hooks)
+}
+
+// getOwnedWebhook authenticates the request and loads the webhook in the
+// webhookID path value, responding with an error unless the caller owns it.
+func (cfg *apiConfig) getOwnedWebhook(w http.ResponseWriter, r *http.Request) (database.Webhook, bool) {
+	webhookID, err := uuid.Parse(r.PathValue("webhookID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		return database.Webhook{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return database.Webhook{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return database.Webhook{}, false
+	}
+
+	webhook, err := cfg.db.GetWebhook(r.Context(), webhookID)
+	if err != nil || webhook.ID == uuid.Nil || webhook.UserID != userID {
+		respondWithError(w, http.StatusNotFound, "Couldn't get webhook", err)
+		return database.Webhook{}, false
+	}
+	return webhook, true
+}
+
+func (cfg *apiConfig) handlerWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := cfg.getOwnedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DeleteWebhook(r.Context(), webhook.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't delete webhook", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) handlerWebhookDeliveriesRetrieve(w http.ResponseWriter, r *http.Request) {
+	webhook, ok := cfg.getOwnedWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	limit := webhookDeliveriesDefaultLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer", err)
+			return
+		}
+		limit = min(n, webhookDeliveriesMaxLimit)
+	}
+
+	deliveries, err := cfg.db.GetWebhookDeliveries(r.Context(), webhook.ID, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve webhook deliveries", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// videoEventData is what events tell webhooks about a video. It's the video
+// without its video_url, which is the internal bucket and key.
+type videoEventData struct {
+	ID               uuid.UUID           `json:"id"`
+	CreatedAt        time.Time           `json:"created_at"`
+	UpdatedAt        time.Time           `json:"updated_at"`
+	ThumbnailURL     *string             `json:"thumbnail_url"`
+	CurrentVersionID *uuid.UUID          `json:"current_version_id"`
+	Title            string              `json:"title"`
+	Description      string              `json:"description"`
+	UserID           uuid.UUID           `json:"user_id"`
+	Visibility       database.Visibility `json:"visibility"`
+	PublishAt        *time.Time          `json:"publish_at"`
+	UnpublishAt      *time.Time          `json:"unpublish_at"`
+}
+
+func newVideoEventData(video database.Video) videoEventData {
+	return videoEventData{
+		ID:               video.ID,
+		CreatedAt:        video.CreatedAt,
+		UpdatedAt:        video.UpdatedAt,
+		ThumbnailURL:     video.ThumbnailURL,
+		CurrentVersionID: video.CurrentVersionID,
+		Title:            video.Title,
+		Description:      video.Description,
+		UserID:           video.UserID,
+		Visibility:       video.Visibility,
+		PublishAt:        video.PublishAt,
+		UnpublishAt:      video.UnpublishAt,
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// readinessTimeout bounds how long /readyz waits on any one dependency, so
+// a hung check reports as failed rather than hanging the probe.
+const readinessTimeout = 5 * time.Second
+
+// readinessCacheTTL is how long the result of the checks is reused. They
+// start processes and call storage, so probes hitting /readyz often
+// shouldn't run them every time.
+const readinessCacheTTL = 5 * time.Second
+
+type checkStatus string
+
+const (
+	checkStatusOK      checkStatus = "ok"
+	checkStatusFailed  checkStatus = "failed"
+	checkStatusSkipped checkStatus = "skipped"
+)
+
+type checkResult struct {
+	Status     checkStatus `json:"status"`
+	DurationMS int64       `json:"duration_ms"`
+	Detail     string      `json:"detail,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+type readinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// readinessCache holds the last readiness report. Requests that come in
+// while the checks run wait for them rather than running their own.
+type readinessCache struct {
+	mu        sync.Mutex
+	report    readinessReport
+	checkedAt time.Time
+}
+
+// readinessCheck returns a detail worth reporting on success, or
+// errors.ErrUnsupported when it can't run on this platform.
+type readinessCheck func(ctx context.Context) (string, error)
+
+func (cfg *apiConfig) handlerHealthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{
+		Status: "ok",
+	})
+}
+
+// handlerReadyz responds 503 if any dependency check failed, so load
+// balancers stop routing to a broken instance. It's public, so it only
+// gives the overall status; the checks' details are in handlerReadyzReport.
+func (cfg *apiConfig) handlerReadyz(w http.ResponseWriter, r *http.Request) {
+	report := cfg.readinessReport(r.Context())
+	respondWithJSON(w, readinessHTTPStatus(report), struct {
+		Status string `json:"status"`
+	}{
+		Status: report.Status,
+	})
+}
+
+// handlerReadyzReport responds like handlerReadyz with the result of every
+// check. The errors include paths and storage errors, so it's only served
+// on the metrics address.
+func (cfg *apiConfig) handlerReadyzReport(w http.ResponseWriter, r *http.Request) {
+	report := cfg.readinessReport(r.Context())
+	respondWithJSON(w, readinessHTTPStatus(report), report)
+}
+
+func readinessHTTPStatus(report readinessReport) int {
+	if report.Status != "ok" {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+// readinessReport returns the result of the dependency checks, running them
+// if the last result is older than readinessCacheTTL.
+func (cfg *apiConfig) readinessReport(ctx context.Context) readinessReport {
+	cfg.readiness.mu.Lock()
+	defer cfg.readiness.mu.Unlock()
+	if time.Since(cfg.readiness.checkedAt) < readinessCacheTTL {
+		return cfg.readiness.report
+	}
+	// the result is shared, so a caller going away mustn't fail it
+	cfg.readiness.report = cfg.runReadinessChecks(context.WithoutCancel(ctx))
+	cfg.readiness.checkedAt = time.Now()
+	return cfg.readiness.report
+}
+
+// runReadinessChecks runs every dependency check in parallel.
+func (cfg *apiConfig) runReadinessChecks(ctx context.Context) readinessReport {
+	checks := map[string]readinessCheck{
+		"database": cfg.checkDatabase,
+		"storage":  cfg.checkStorage,
+		"ffmpeg":   checkCommandVersion("ffmpeg"),
+		"ffprobe":  checkCommandVersion("ffprobe"),
+		"temp_dir": cfg.checkTempDir,
+		"assets":   cfg.checkAssetsWritable,
+	}
+
+	report := readinessReport{
+		Status: "ok",
+		Checks: make(map[string]checkResult, len(checks)),
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := runReadinessCheck(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status == checkStatusFailed {
+				report.Status = "degraded"
+			}
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+func runReadinessCheck(ctx context.Context, check readinessCheck) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	detail, err := check(ctx)
+	result := checkResult{
+		Status:     checkStatusOK,
+		DurationMS: time.Since(start).Milliseconds(),
+		Detail:     detail,
+	}
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		result.Status = checkStatusSkipped
+		result.Detail = "not supported on this platform"
+	case err != nil:
+		result.Status = checkStatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (cfg *apiConfig) checkDatabase(ctx context.Context) (string, error) {
+	return "", cfg.db.Ping(ctx)
+}
+
+func (cfg *apiConfig) checkStorage(ctx context.Context) (string, error) {
+	_, err := cfg.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(cfg.s3Bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	return cfg.s3Bucket, nil
+}
+
+// checkCommandVersion runs "<name> -version" and reports the version from
+// its first line, e.g. "ffmpeg version 7.1 Copyright ...".
+func checkCommandVersion(name string) readinessCheck {
+	return func(ctx context.Context) (string, error) {
+		out, err := exec.CommandContext(ctx, name, "-version").Output()
+		if err != nil {
+			return "", fmt.Errorf("couldn't run %s: %w", name, err)
+		}
+		firstLine, _, _ := strings.Cut(string(out), "\n")
+		fields := strings.Fields(firstLine)
+		if len(fields) < 3 || fields[1] != "version" {
+			return strings.TrimSpace(firstLine), nil
+		}
+		return fields[2], nil
+	}
+}
+
+func (cfg *apiConfig) checkTempDir(ctx context.Context) (string, error) {
+	free, err := freeDiskSpace(os.TempDir())
+	if err != nil {
+		return "", err
+	}
+	detail := fmt.Sprintf("%d bytes free", free)
+	if free < cfg.minTempFreeBytes {
+		return "", fmt.Errorf("only %d bytes free in %s, need %d", free, os.TempDir(), cfg.minTempFreeBytes)
+	}
+	return detail, nil
+}
+
+func (cfg *apiConfig) checkAssetsWritable(ctx context.Context) (string, error) {
+	f, err := os.CreateTemp(cfg.assetsRoot, ".readyz-*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return "", os.Remove(f.Name())
+}
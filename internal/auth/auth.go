@@ -2,6 +2,7 @@ package auth
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -18,6 +19,14 @@ type TokenType string
 
 const (
 	TokenTypeAccess TokenType = "tubely-access"
+	// TokenTypeMFA is a short-lived token proving the password step of a
+	// two-step login succeeded. It can't be used as an access token.
+	TokenTypeMFA TokenType = "tubely-mfa"
+	// TokenTypeMedia is a short-lived token for playing or following one
+	// video from elements that can't send an Authorization header, such as
+	// <video> and EventSource. It goes in URLs, so it's scoped to the video
+	// and can't be used as an access token.
+	TokenTypeMedia TokenType = "tubely-media"
 )
 
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
@@ -36,48 +45,98 @@ func CheckPasswordHash(password, hash string) error {
 
 func MakeJWT(
 	userID uuid.UUID,
-	tokenSecret string,
+	keys *KeySet,
 	expiresIn time.Duration,
 ) (string, error) {
-	signingKey := []byte(tokenSecret)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    string(TokenTypeAccess),
+	return makeToken(userID, TokenTypeAccess, keys, expiresIn)
+}
+
+func ValidateJWT(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, TokenTypeAccess, keys)
+	return claims.UserID, err
+}
+
+// AccessClaims are what a validated access token says about its user.
+type AccessClaims struct {
+	UserID   uuid.UUID
+	IssuedAt time.Time
+}
+
+// ValidateJWTClaims is ValidateJWT for callers that also need to know when
+// the token was issued, such as to honour revocations.
+func ValidateJWTClaims(tokenString string, keys *KeySet) (AccessClaims, error) {
+	return validateToken(tokenString, TokenTypeAccess, keys)
+}
+
+func MakeMFAToken(userID uuid.UUID, keys *KeySet, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, TokenTypeMFA, keys, expiresIn)
+}
+
+func ValidateMFAToken(tokenString string, keys *KeySet) (uuid.UUID, error) {
+	claims, err := validateToken(tokenString, TokenTypeMFA, keys)
+	return claims.UserID, err
+}
+
+// MakeMediaToken makes a media token for a video. Its audience is the video,
+// so it's only accepted for that video.
+func MakeMediaToken(userID, videoID uuid.UUID, keys *KeySet, expiresIn time.Duration) (string, error) {
+	return makeToken(userID, TokenTypeMedia, keys, expiresIn, videoID.String())
+}
+
+func ValidateMediaToken(tokenString string, videoID uuid.UUID, keys *KeySet) (AccessClaims, error) {
+	return validateToken(tokenString, TokenTypeMedia, keys, jwt.WithAudience(videoID.String()))
+}
+
+func makeToken(
+	userID uuid.UUID,
+	tokenType TokenType,
+	keys *KeySet,
+	expiresIn time.Duration,
+	audience ...string,
+) (string, error) {
+	return keys.sign(jwt.RegisteredClaims{
+		Issuer:    string(tokenType),
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
+		Audience:  audience,
 	})
-	return token.SignedString(signingKey)
 }
 
-func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+func validateToken(tokenString string, tokenType TokenType, keys *KeySet, opts ...jwt.ParserOption) (AccessClaims, error) {
 	claimsStruct := jwt.RegisteredClaims{}
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		&claimsStruct,
-		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+		keys.keyfunc,
+		append(opts, jwt.WithValidMethods(keys.validMethods()))...,
 	)
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
 
 	userIDString, err := token.Claims.GetSubject()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
 
 	issuer, err := token.Claims.GetIssuer()
 	if err != nil {
-		return uuid.Nil, err
+		return AccessClaims{}, err
 	}
-	if issuer != string(TokenTypeAccess) {
-		return uuid.Nil, errors.New("invalid issuer")
+	if issuer != string(tokenType) {
+		return AccessClaims{}, errors.New("invalid issuer")
 	}
 
 	id, err := uuid.Parse(userIDString)
 	if err != nil {
-		return uuid.Nil, fmt.Errorf("invalid user ID: %w", err)
+		return AccessClaims{}, fmt.Errorf("invalid user ID: %w", err)
+	}
+	claims := AccessClaims{UserID: id}
+	if claimsStruct.IssuedAt != nil {
+		claims.IssuedAt = claimsStruct.IssuedAt.Time
 	}
-	return id, nil
+	return claims, nil
 }
 
 func GetBearerToken(headers http.Header) (string, error) {
@@ -114,3 +173,10 @@ func GetAPIKey(headers http.Header) (string, error) {
 
 	return splitAuth[1], nil
 }
+
+// HashToken returns the SHA-256 hex digest of a high-entropy token so it can
+// be stored and looked up without keeping the token itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownKeyID = errors.New("unknown signing key id")
+
+type verificationKey struct {
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// KeySet holds the key used to sign new tokens and every key that is still
+// accepted when verifying them. During a rotation the old key stays in the
+// set as verification-only until all tokens it signed have expired.
+type KeySet struct {
+	signingKeyID  string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.PrivateKey
+	keys          map[string]verificationKey
+	hmacSecret    []byte
+}
+
+// NewHMACKeySet returns a key set that signs and verifies with a single
+// HS256 shared secret.
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{
+		signingMethod: jwt.SigningMethodHS256,
+		signingKey:    []byte(secret),
+		keys:          map[string]verificationKey{},
+		hmacSecret:    []byte(secret),
+	}
+}
+
+// LoadKeySet reads every *.pem file in dir. The file name without its
+// extension is used as the key id. Private keys (RSA or Ed25519) can sign
+// and verify, public keys are verification-only. The signing key is the one
+// named by signingKeyID or, if that is empty, the last private key in file
+// name order. If legacySecret is set, HS256 tokens signed with it are still
+// accepted so existing sessions survive the switch to asymmetric keys.
+func LoadKeySet(dir, signingKeyID, legacySecret string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	ks := &KeySet{
+		keys: map[string]verificationKey{},
+	}
+	if legacySecret != "" {
+		ks.hmacSecret = []byte(legacySecret)
+	}
+
+	var lastPrivate string
+	privateKeys := map[string]crypto.PrivateKey{}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read key %s: %w", path, err)
+		}
+		private, public, err := parsePEMKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse key %s: %w", path, err)
+		}
+		method, err := signingMethodForKey(public)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", path, err)
+		}
+		ks.keys[kid] = verificationKey{method: method, key: public}
+		if private != nil {
+			privateKeys[kid] = private
+			lastPrivate = kid
+		}
+	}
+
+	if signingKeyID == "" {
+		signingKeyID = lastPrivate
+	}
+	if signingKeyID == "" {
+		return nil, fmt.Errorf("no private signing key found in %s", dir)
+	}
+	private, ok := privateKeys[signingKeyID]
+	if !ok {
+		return nil, fmt.Errorf("signing key %q not found in %s", signingKeyID, dir)
+	}
+	ks.signingKeyID = signingKeyID
+	ks.signingMethod = ks.keys[signingKeyID].method
+	ks.signingKey = private
+
+	return ks, nil
+}
+
+func parsePEMKey(data []byte) (crypto.PrivateKey, crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM block found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, nil, errors.New("private key can't sign")
+		}
+		return key, signer.Public(), nil
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, &key.PublicKey, nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, key, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, key, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+func signingMethodForKey(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PublicKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func (ks *KeySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	if ks.signingKeyID != "" {
+		token.Header["kid"] = ks.signingKeyID
+	}
+	return token.SignedString(ks.signingKey)
+}
+
+func (ks *KeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		if ks.hmacSecret == nil {
+			return nil, errors.New("HS256 tokens are not accepted")
+		}
+		return ks.hmacSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+	if key.method.Alg() != token.Method.Alg() {
+		return nil, fmt.Errorf("key %s does not use %s", kid, token.Method.Alg())
+	}
+	return key.key, nil
+}
+
+func (ks *KeySet) validMethods() []string {
+	methods := []string{}
+	if ks.hmacSecret != nil {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	seen := map[string]bool{}
+	for _, key := range ks.keys {
+		alg := key.method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			methods = append(methods, alg)
+		}
+	}
+	return methods
+}
+
+// JWK is a single public key in JSON Web Key format.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public half of every asymmetric key in the set. Shared
+// HMAC secrets are never published.
+func (ks *KeySet) JWKS() JWKS {
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	set := JWKS{Keys: []JWK{}}
+	for _, kid := range kids {
+		key := ks.keys[kid]
+		jwk := JWK{
+			KeyID:     kid,
+			Use:       "sig",
+			Algorithm: key.method.Alg(),
+		}
+		switch pub := key.key.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes, written like "500MB" or "10GB" using
+// binary units. A bare number is bytes.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func ParseByteSize(input string) (ByteSize, error) {
+	s := strings.ToUpper(strings.TrimSpace(input))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB or 10GB", input)
+	}
+	if n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("size %q is too large", input)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// MarshalText writes the size in the largest unit that divides it exactly.
+func (b ByteSize) MarshalText() ([]byte, error) {
+	for _, unit := range byteUnits {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return []byte(strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix), nil
+		}
+	}
+	return []byte("0"), nil
+}
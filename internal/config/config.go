@@ -0,0 +1,190 @@
+// Package config loads the server's settings from a YAML file, the
+// environment and command-line flags, in increasing order of precedence.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+)
+
+// Config is every setting the server takes. Each field is set by its yaml
+// key in the config file, by the environment variable in its env tag, and
+// by a flag named after its yaml path, e.g. s3.bucket is -s3-bucket.
+// Fields tagged secret are redacted when printed.
+type Config struct {
+	Port          string `yaml:"port" env:"PORT" help:"port to serve HTTP on"`
+	Platform      string `yaml:"platform" env:"PLATFORM" help:"\"dev\" enables development-only endpoints"`
+	PublicBaseURL string `yaml:"public_base_url" env:"PUBLIC_BASE_URL" help:"URL the app is reached at, used in emailed links (default http://localhost:<port>)"`
+	FilepathRoot  string `yaml:"filepath_root" env:"FILEPATH_ROOT" help:"directory the web app is served from"`
+	AssetsRoot    string `yaml:"assets_root" env:"ASSETS_ROOT" help:"directory thumbnails are stored in"`
+	DBPath        string `yaml:"db_path" env:"DB_PATH" help:"path to the SQLite database"`
+
+	Log       LogConfig       `yaml:"log"`
+	JWT       JWTConfig       `yaml:"jwt"`
+	S3        S3Config        `yaml:"s3"`
+	Mail      MailConfig      `yaml:"mail"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Quota     QuotaConfig     `yaml:"quota"`
+
+	VideoVersionRetention int           `yaml:"video_version_retention" env:"VIDEO_VERSION_RETENTION" help:"uploads of each video kept for rollback, 0 keeps all"`
+	AdminAPIKey           string        `yaml:"admin_api_key" env:"ADMIN_API_KEY" secret:"true" help:"enables the admin endpoints, sent as \"Authorization: ApiKey <key>\""`
+	MetricsAddr           string        `yaml:"metrics_addr" env:"METRICS_ADDR" help:"serve /metrics and the detailed /readyz on this address, e.g. 127.0.0.1:9091; off if unset"`
+	MinTempFree           ByteSize      `yaml:"min_temp_free" env:"MIN_TEMP_FREE" help:"free temp space below which /readyz reports degraded"`
+	ShutdownTimeout       time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" help:"how long to wait for in-flight requests when stopping"`
+}
+
+type LogConfig struct {
+	Format string `yaml:"format" env:"LOG_FORMAT" help:"json or text"`
+	Level  string `yaml:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+}
+
+type JWTConfig struct {
+	Secret       string `yaml:"secret" env:"JWT_SECRET" secret:"true" help:"HMAC secret for access tokens"`
+	KeysDir      string `yaml:"keys_dir" env:"JWT_KEYS_DIR" help:"directory of <kid>.pem signing keys, used instead of the secret"`
+	SigningKeyID string `yaml:"signing_key_id" env:"JWT_SIGNING_KEY_ID" help:"kid of the key in keys_dir to sign with"`
+}
+
+type S3Config struct {
+	Bucket         string `yaml:"bucket" env:"S3_BUCKET" help:"bucket videos are stored in"`
+	Region         string `yaml:"region" env:"S3_REGION" help:"region of the bucket"`
+	CFDistribution string `yaml:"cf_distribution" env:"S3_CF_DISTRO" help:"CloudFront distribution in front of the bucket"`
+}
+
+type MailConfig struct {
+	Mailer       string `yaml:"mailer" env:"MAILER" help:"smtp or log"`
+	From         string `yaml:"from" env:"MAIL_FROM" help:"From address of sent mail"`
+	LogPath      string `yaml:"log_path" env:"MAIL_LOG_PATH" help:"file the log mailer appends to, stdout if unset"`
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort     string `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer" env:"OIDC_ISSUER" help:"enables single sign-on with this OpenID Connect provider"`
+	ClientID     string `yaml:"client_id" env:"OIDC_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	RedirectURL  string `yaml:"redirect_url" env:"OIDC_REDIRECT_URL"`
+}
+
+type RateLimitConfig struct {
+	Default            string `yaml:"default" env:"RATE_LIMIT_DEFAULT" help:"limit for routes without their own, e.g. 300/m"`
+	Routes             string `yaml:"routes" env:"RATE_LIMITS" help:"per-route limits, e.g. \"POST /api/login=10/m;POST /api/users=5/m\""`
+	TrustXForwardedFor bool   `yaml:"trust_x_forwarded_for" env:"TRUST_X_FORWARDED_FOR" help:"take the client IP from X-Forwarded-For, only safe behind a proxy"`
+}
+
+type QuotaConfig struct {
+	MaxBytes  ByteSize `yaml:"max_bytes" env:"QUOTA_MAX_BYTES" help:"default storage per user, 0 is unlimited"`
+	MaxVideos int      `yaml:"max_videos" env:"QUOTA_MAX_VIDEOS" help:"default videos per user, 0 is unlimited"`
+}
+
+// Default returns the settings used where nothing else sets them.
+func Default() Config {
+	return Config{
+		Log: LogConfig{
+			Format: "json",
+			Level:  "info",
+		},
+		Mail: MailConfig{
+			Mailer:   "log",
+			From:     "Tubely <no-reply@localhost>",
+			SMTPPort: "587",
+		},
+		RateLimit: RateLimitConfig{
+			Default: "300/m",
+		},
+		VideoVersionRetention: 5,
+		MinTempFree:           1 << 30,
+		ShutdownTimeout:       30 * time.Second,
+	}
+}
+
+// Validate reports every problem with the config at once, rather than
+// making the operator fix them one restart at a time.
+func (c Config) Validate() error {
+	var errs []error
+	required := func(value, name string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", name))
+		}
+	}
+
+	required(c.Port, "port (PORT)")
+	required(c.Platform, "platform (PLATFORM)")
+	required(c.FilepathRoot, "filepath_root (FILEPATH_ROOT)")
+	required(c.AssetsRoot, "assets_root (ASSETS_ROOT)")
+	required(c.DBPath, "db_path (DB_PATH)")
+	required(c.S3.Bucket, "s3.bucket (S3_BUCKET)")
+	required(c.S3.Region, "s3.region (S3_REGION)")
+	required(c.S3.CFDistribution, "s3.cf_distribution (S3_CF_DISTRO)")
+	if c.JWT.Secret == "" && c.JWT.KeysDir == "" {
+		errs = append(errs, errors.New("jwt.secret (JWT_SECRET) or jwt.keys_dir (JWT_KEYS_DIR) must be set"))
+	}
+
+	if c.PublicBaseURL != "" {
+		if u, err := url.Parse(c.PublicBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("public_base_url %q must be an absolute URL", c.PublicBaseURL))
+		}
+	}
+
+	switch c.Log.Format {
+	case "json", "text":
+	default:
+		errs = append(errs, fmt.Errorf("log.format %q must be json or text", c.Log.Format))
+	}
+	switch strings.ToLower(c.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level %q must be debug, info, warn or error", c.Log.Level))
+	}
+
+	switch c.Mail.Mailer {
+	case "log":
+	case "smtp":
+		required(c.Mail.SMTPHost, "mail.smtp_host (SMTP_HOST) for the smtp mailer")
+	default:
+		errs = append(errs, fmt.Errorf("mail.mailer %q must be smtp or log", c.Mail.Mailer))
+	}
+
+	if c.OIDC.Issuer != "" {
+		required(c.OIDC.ClientID, "oidc.client_id (OIDC_CLIENT_ID) with oidc.issuer")
+		required(c.OIDC.RedirectURL, "oidc.redirect_url (OIDC_REDIRECT_URL) with oidc.issuer")
+	}
+
+	if _, err := ratelimit.ParseLimit(c.RateLimit.Default); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.default: %w", err))
+	}
+	if _, err := ratelimit.ParseRouteLimits(c.RateLimit.Routes); err != nil {
+		errs = append(errs, fmt.Errorf("rate_limit.routes: %w", err))
+	}
+
+	if c.Quota.MaxVideos < 0 {
+		errs = append(errs, errors.New("quota.max_videos can't be negative"))
+	}
+	if c.VideoVersionRetention < 0 {
+		errs = append(errs, errors.New("video_version_retention can't be negative"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// Redacted returns a copy with every secret that is set replaced, so the
+// config can be printed or logged.
+func (c Config) Redacted() Config {
+	for _, f := range fields(&c) {
+		if f.secret && f.value.String() != "" {
+			f.value.SetString(redacted)
+		}
+	}
+	return c
+}
+
+const redacted = "[redacted]"
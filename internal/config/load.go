@@ -0,0 +1,175 @@
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// field is one setting of a Config, found through its struct tags.
+type field struct {
+	path   string // yaml path, e.g. "s3.bucket"
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+func (f field) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.path)
+}
+
+// fields lists the settings of c, in declaration order, as settable
+// values.
+func fields(c *Config) []field {
+	var out []field
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			path := prefix + sf.Tag.Get("yaml")
+			if sf.Type.Kind() == reflect.Struct && sf.Tag.Get("env") == "" {
+				walk(v.Field(i), path+".")
+				continue
+			}
+			out = append(out, field{
+				path:   path,
+				env:    sf.Tag.Get("env"),
+				help:   sf.Tag.Get("help"),
+				secret: sf.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return out
+}
+
+// set parses s into the field according to its type.
+func (f field) set(s string) error {
+	if u, ok := f.value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(s))
+	}
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		f.value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, expected e.g. 30s", s)
+		}
+		f.value.SetInt(int64(d))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.value.Type())
+	}
+	return nil
+}
+
+// Loader reads a Config. Its flags are registered on a FlagSet, which has
+// to be parsed before calling Load.
+type Loader struct {
+	path  string
+	flags map[string]string
+}
+
+// NewLoader registers -config and a flag for every setting on fs.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{flags: map[string]string{}}
+	fs.StringVar(&l.path, "config", os.Getenv("CONFIG_FILE"), "path to a YAML config file (CONFIG_FILE)")
+
+	defaults := Default()
+	for _, f := range fields(&defaults) {
+		usage := f.help
+		if f.env != "" {
+			usage = strings.TrimSpace(usage + " (" + f.env + ")")
+		}
+		record := func(s string) error {
+			l.flags[f.path] = s
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			fs.BoolFunc(f.flagName(), usage, record)
+		} else {
+			fs.Func(f.flagName(), usage, record)
+		}
+	}
+	return l
+}
+
+// Load builds the config from the defaults, then the config file, then the
+// environment, then any flags that were set, and validates the result.
+func (l *Loader) Load() (Config, error) {
+	cfg := Default()
+
+	if l.path != "" {
+		f, err := os.Open(l.path)
+		if err != nil {
+			return Config{}, fmt.Errorf("couldn't open config file: %w", err)
+		}
+		defer f.Close()
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return Config{}, fmt.Errorf("couldn't parse config file %s: %w", l.path, err)
+		}
+	}
+
+	var errs []error
+	for _, f := range fields(&cfg) {
+		if s, ok := os.LookupEnv(f.env); ok && f.env != "" && s != "" {
+			if err := f.set(s); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			}
+		}
+		if s, ok := l.flags[f.path]; ok {
+			if err := f.set(s); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", f.flagName(), err))
+			}
+		}
+	}
+
+	if cfg.PublicBaseURL == "" && cfg.Port != "" {
+		cfg.PublicBaseURL = "http://localhost:" + cfg.Port
+	}
+	cfg.PublicBaseURL = strings.TrimSuffix(cfg.PublicBaseURL, "/")
+
+	if err := cfg.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+	return cfg, nil
+}
+
+// Print writes the config as YAML with its secrets redacted.
+func Print(w io.Writer, cfg Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -8,15 +9,24 @@ import (
 )
 
 type Client struct {
-	db *sql.DB
+	db *timedDB
 }
 
+// NewClient opens the database at pathToDB and brings its schema up to date.
+//
+// Foreign keys are deliberately left unenforced: SQLite only checks them
+// with PRAGMA foreign_keys on, and the REFERENCES clauses in the schema have
+// no ON DELETE actions, which existing tables can't gain without being
+// rebuilt. Turning enforcement on could also start failing writes to
+// databases that already hold orphaned rows. Instead, the methods that delete
+// rows other tables refer to, such as DeleteVideo and DeleteUser, delete the
+// dependent rows themselves in the same transaction.
 func NewClient(pathToDB string) (Client, error) {
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{&timedDB{DB: db}}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -25,6 +35,28 @@ func NewClient(pathToDB string) (Client, error) {
 
 }
 
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
+// Ping checks the database can still be reached.
+func (c Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// Backup writes a consistent copy of the database to path, which must not
+// exist yet. The database stays usable while it runs.
+func (c Client) Backup(ctx context.Context, path string) error {
+	_, err := c.db.ExecContext(ctx, "VACUUM INTO ?", path)
+	return err
+}
+
+// ObserveQueries reports the duration of every query from now on to
+// observe, e.g. to export them as metrics.
+func (c Client) ObserveQueries(observe QueryObserver) {
+	c.db.observe = observe
+}
+
 func (c *Client) autoMigrate() error {
 	userTable := `
 	CREATE TABLE IF NOT EXISTS users (
@@ -72,17 +104,385 @@ func (c *Client) autoMigrate() error {
 	if err != nil {
 		return err
 	}
+
+	oidcLoginStateTable := `
+	CREATE TABLE IF NOT EXISTS oidc_login_states (
+		state TEXT PRIMARY KEY,
+		nonce TEXT NOT NULL,
+		code_verifier TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.Exec(oidcLoginStateTable)
+	if err != nil {
+		return err
+	}
+
+	userIdentityTable := `
+	CREATE TABLE IF NOT EXISTS user_identities (
+		issuer TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(issuer, subject),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userIdentityTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumn("users", "email_verified_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("users", "failed_login_count", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("users", "locked_until", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("users", "disabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("users", "tokens_revoked_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("users", "delete_after", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumn("videos", "visibility", "TEXT NOT NULL DEFAULT 'private'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "publish_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "unpublish_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+
+	userTokenTable := `
+	CREATE TABLE IF NOT EXISTS user_tokens (
+		token_hash TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		purpose TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userTokenTable)
+	if err != nil {
+		return err
+	}
+
+	userTOTPTable := `
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id TEXT PRIMARY KEY,
+		secret TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		enabled_at TIMESTAMP,
+		last_used_step INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userTOTPTable)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodeTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		code_hash TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(recoveryCodeTable)
+	if err != nil {
+		return err
+	}
+
+	shareLinkTable := `
+	CREATE TABLE IF NOT EXISTS share_links (
+		id TEXT PRIMARY KEY,
+		token_hash TEXT UNIQUE NOT NULL,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP,
+		password_hash TEXT,
+		max_views INTEGER,
+		view_count INTEGER NOT NULL DEFAULT 0,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(shareLinkTable)
+	if err != nil {
+		return err
+	}
+
+	webhookTable := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(webhookTable)
+	if err != nil {
+		return err
+	}
+
+	webhookDeliveryTable := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id TEXT PRIMARY KEY,
+		webhook_id TEXT NOT NULL,
+		event_id TEXT NOT NULL,
+		event_type TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMP,
+		last_attempt_at TIMESTAMP,
+		response_status INTEGER,
+		last_error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		delivered_at TIMESTAMP,
+		FOREIGN KEY(webhook_id) REFERENCES webhooks(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due
+		ON webhook_deliveries(status, next_attempt_at);
+	`
+	_, err = c.db.Exec(webhookDeliveryTable)
+	if err != nil {
+		return err
+	}
+
+	videoVersionTable := `
+	CREATE TABLE IF NOT EXISTS video_versions (
+		id TEXT PRIMARY KEY,
+		video_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		bucket TEXT NOT NULL,
+		key TEXT NOT NULL,
+		content_type TEXT,
+		size_bytes INTEGER,
+		aspect_ratio TEXT,
+		duration_seconds REAL,
+		uploaded_by TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(video_id, version),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(uploaded_by) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(videoVersionTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("videos", "current_version_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.backfillVideoVersions()
+	if err != nil {
+		return err
+	}
+
+	blobTable := `
+	CREATE TABLE IF NOT EXISTS blobs (
+		sha256 TEXT PRIMARY KEY,
+		bucket TEXT NOT NULL,
+		key TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		size_bytes INTEGER NOT NULL,
+		aspect_ratio TEXT NOT NULL,
+		duration_seconds REAL NOT NULL,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = c.db.Exec(blobTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("video_versions", "blob_sha256", "TEXT REFERENCES blobs(sha256)")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("blobs", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("video_versions", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+
+	userUsageTable := `
+	CREATE TABLE IF NOT EXISTS user_usage (
+		user_id TEXT PRIMARY KEY,
+		bytes_used INTEGER NOT NULL DEFAULT 0,
+		video_count INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userUsageTable)
+	if err != nil {
+		return err
+	}
+
+	userQuotaTable := `
+	CREATE TABLE IF NOT EXISTS user_quotas (
+		user_id TEXT PRIMARY KEY,
+		max_bytes INTEGER,
+		max_videos INTEGER,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.Exec(userQuotaTable)
+	if err != nil {
+		return err
+	}
+
+	exportTable := `
+	CREATE TABLE IF NOT EXISTS exports (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL,
+		bucket TEXT,
+		key TEXT,
+		size_bytes INTEGER,
+		error TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		completed_at TIMESTAMP,
+		expires_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_exports_status
+		ON exports(status, created_at);
+	`
+	_, err = c.db.Exec(exportTable)
+	if err != nil {
+		return err
+	}
+	err = c.addColumn("exports", "claimed_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	return c.backfillUserUsage()
+}
+
+// addColumn adds a column to a table created by an older version of the
+// schema. CREATE TABLE IF NOT EXISTS leaves existing tables untouched, so new
+// columns on old tables have to be added here.
+func (c *Client) addColumn(table, column, definition string) error {
+	rows, err := c.db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = c.db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("couldn't add column %s.%s: %w", table, column, err)
+	}
 	return nil
 }
 
-func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
+func (c Client) Reset(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM exports"); err != nil {
+		return fmt.Errorf("failed to reset table exports: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM refresh_tokens"); err != nil {
 		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM webhook_deliveries"); err != nil {
+		return fmt.Errorf("failed to reset table webhook_deliveries: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM webhooks"); err != nil {
+		return fmt.Errorf("failed to reset table webhooks: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_usage"); err != nil {
+		return fmt.Errorf("failed to reset table user_usage: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_quotas"); err != nil {
+		return fmt.Errorf("failed to reset table user_quotas: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM video_versions"); err != nil {
+		return fmt.Errorf("failed to reset table video_versions: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM blobs"); err != nil {
+		return fmt.Errorf("failed to reset table blobs: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM share_links"); err != nil {
+		return fmt.Errorf("failed to reset table share_links: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_totp"); err != nil {
+		return fmt.Errorf("failed to reset table user_totp: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table user_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM user_identities"); err != nil {
+		return fmt.Errorf("failed to reset table user_identities: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM oidc_login_states"); err != nil {
+		return fmt.Errorf("failed to reset table oidc_login_states: %w", err)
+	}
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM users"); err != nil {
 		return fmt.Errorf("failed to reset table users: %w", err)
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.db.ExecContext(ctx, "DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
 	return nil
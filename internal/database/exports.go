@@ -0,0 +1,292 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ExportStatus string
+
+const (
+	ExportStatusPending ExportStatus = "pending"
+	ExportStatusRunning ExportStatus = "running"
+	ExportStatusReady   ExportStatus = "ready"
+	ExportStatusFailed  ExportStatus = "failed"
+	// ExportStatusExpired exports have had their archive deleted
+	ExportStatusExpired ExportStatus = "expired"
+)
+
+// ErrExportClaimLost is returned when finishing an export that's no longer
+// running, because its claim lapsed and it was taken over or cancelled.
+var ErrExportClaimLost = errors.New("export is no longer claimed")
+
+// Export is a request for an archive of everything a user has stored. It's
+// built in the background and kept in storage until ExpiresAt.
+type Export struct {
+	ID          uuid.UUID    `json:"id"`
+	UserID      uuid.UUID    `json:"user_id"`
+	Status      ExportStatus `json:"status"`
+	Bucket      *string      `json:"-"`
+	Key         *string      `json:"-"`
+	SizeBytes   *int64       `json:"size_bytes"`
+	Error       *string      `json:"error"`
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+	CompletedAt *time.Time   `json:"completed_at"`
+	ExpiresAt   *time.Time   `json:"expires_at"`
+}
+
+const exportColumns = `
+		id,
+		user_id,
+		status,
+		bucket,
+		key,
+		size_bytes,
+		error,
+		created_at,
+		updated_at,
+		completed_at,
+		expires_at`
+
+func scanExport(row rowScanner) (Export, error) {
+	var e Export
+	err := row.Scan(
+		&e.ID,
+		&e.UserID,
+		&e.Status,
+		&e.Bucket,
+		&e.Key,
+		&e.SizeBytes,
+		&e.Error,
+		&e.CreatedAt,
+		&e.UpdatedAt,
+		&e.CompletedAt,
+		&e.ExpiresAt,
+	)
+	return e, err
+}
+
+func (c Client) queryExports(ctx context.Context, query string, args ...any) ([]Export, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []Export{}
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+func (c Client) CreateExport(ctx context.Context, userID uuid.UUID) (Export, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO exports (id, user_id, status, created_at, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.ExecContext(ctx, query, id, userID, ExportStatusPending)
+	if err != nil {
+		return Export{}, err
+	}
+	return c.GetExport(ctx, id)
+}
+
+func (c Client) GetExport(ctx context.Context, id uuid.UUID) (Export, error) {
+	query := `
+	SELECT` + exportColumns + `
+	FROM exports
+	WHERE id = ?
+	`
+	e, err := scanExport(c.db.QueryRowContext(ctx, query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Export{}, nil
+	}
+	return e, err
+}
+
+func (c Client) GetUserExports(ctx context.Context, userID uuid.UUID) ([]Export, error) {
+	query := `
+	SELECT` + exportColumns + `
+	FROM exports
+	WHERE user_id = ?
+	ORDER BY created_at
+	`
+	return c.queryExports(ctx, query, userID)
+}
+
+// GetActiveExport returns the user's export that is waiting or being built,
+// if there is one.
+func (c Client) GetActiveExport(ctx context.Context, userID uuid.UUID) (Export, error) {
+	query := `
+	SELECT` + exportColumns + `
+	FROM exports
+	WHERE user_id = ? AND status IN (?, ?)
+	ORDER BY created_at
+	LIMIT 1
+	`
+	e, err := scanExport(c.db.QueryRowContext(ctx, query, userID, ExportStatusPending, ExportStatusRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Export{}, nil
+	}
+	return e, err
+}
+
+// ClaimPendingExport marks the oldest export that's waiting to be built as
+// running, claimed at now, and returns it, or false if none are waiting.
+// Running exports whose claim is older than staleBefore were abandoned by the
+// server building them, e.g. because it crashed, and are claimed again.
+func (c Client) ClaimPendingExport(ctx context.Context, now, staleBefore time.Time) (Export, bool, error) {
+	query := `
+	UPDATE exports
+	SET status = ?, claimed_at = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (
+		SELECT id FROM exports
+		WHERE status = ?
+		OR (status = ? AND (claimed_at IS NULL OR claimed_at < ?))
+		ORDER BY created_at
+		LIMIT 1
+	)
+	RETURNING` + exportColumns
+	e, err := scanExport(c.db.QueryRowContext(ctx, query,
+		ExportStatusRunning,
+		now,
+		ExportStatusPending,
+		ExportStatusRunning,
+		staleBefore,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Export{}, false, nil
+	}
+	if err != nil {
+		return Export{}, false, err
+	}
+	return e, true, nil
+}
+
+// RenewExportClaim keeps a running export claimed, so other servers don't
+// take it over while it's still being built.
+func (c Client) RenewExportClaim(ctx context.Context, id uuid.UUID, now time.Time) error {
+	query := `
+	UPDATE exports
+	SET claimed_at = ?
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, now, id, ExportStatusRunning)
+	return err
+}
+
+// ReleaseExport puts a running export back in the queue, for when building
+// it was interrupted.
+func (c Client) ReleaseExport(ctx context.Context, id uuid.UUID) error {
+	query := `
+	UPDATE exports
+	SET status = ?, claimed_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, ExportStatusPending, id, ExportStatusRunning)
+	return err
+}
+
+type CompleteExportParams struct {
+	ID        uuid.UUID
+	Bucket    string
+	Key       string
+	SizeBytes int64
+	ExpiresAt time.Time
+}
+
+// CompleteExport records a running export's archive. It returns
+// ErrExportClaimLost if the export isn't running any more.
+func (c Client) CompleteExport(ctx context.Context, params CompleteExportParams) (Export, error) {
+	query := `
+	UPDATE exports
+	SET status = ?, bucket = ?, key = ?, size_bytes = ?, expires_at = ?,
+		completed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	result, err := c.db.ExecContext(ctx, query,
+		ExportStatusReady,
+		params.Bucket,
+		params.Key,
+		params.SizeBytes,
+		params.ExpiresAt,
+		params.ID,
+		ExportStatusRunning,
+	)
+	if err != nil {
+		return Export{}, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return Export{}, err
+	}
+	if n == 0 {
+		return Export{}, ErrExportClaimLost
+	}
+	return c.GetExport(ctx, params.ID)
+}
+
+// FailExport marks a running export as failed. It returns ErrExportClaimLost
+// if the export isn't running any more.
+func (c Client) FailExport(ctx context.Context, id uuid.UUID, message string) error {
+	query := `
+	UPDATE exports
+	SET status = ?, error = ?, completed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	result, err := c.db.ExecContext(ctx, query, ExportStatusFailed, message, id, ExportStatusRunning)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrExportClaimLost
+	}
+	return nil
+}
+
+// FailPendingUserExports marks a user's exports that are waiting to be built
+// as failed, so none of them can be claimed any more.
+func (c Client) FailPendingUserExports(ctx context.Context, userID uuid.UUID, message string) error {
+	query := `
+	UPDATE exports
+	SET status = ?, error = ?, completed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND status = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, ExportStatusFailed, message, userID, ExportStatusPending)
+	return err
+}
+
+// GetExpiredExports returns ready exports whose archive should be deleted.
+func (c Client) GetExpiredExports(ctx context.Context, now time.Time) ([]Export, error) {
+	query := `
+	SELECT` + exportColumns + `
+	FROM exports
+	WHERE status = ? AND expires_at <= ?
+	`
+	return c.queryExports(ctx, query, ExportStatusReady, now)
+}
+
+func (c Client) MarkExportExpired(ctx context.Context, id uuid.UUID) error {
+	query := `
+	UPDATE exports
+	SET status = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, ExportStatusExpired, id)
+	return err
+}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"runtime"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// QueryObserver is told how long each database call took, labelled with the
+// Client method that made it.
+type QueryObserver func(method string, d time.Duration, err error)
+
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database")
+
+// timedDB wraps the connection pool so every query is timed and traced,
+// without each Client method having to do it. Rows are timed until Query
+// returns, not until they've been read.
+type timedDB struct {
+	*sql.DB
+	observe QueryObserver
+}
+
+func (db *timedDB) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, done := db.start(ctx, query)
+	result, err := db.DB.ExecContext(ctx, query, args...)
+	done(err)
+	return result, err
+}
+
+func (db *timedDB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, done := db.start(ctx, query)
+	rows, err := db.DB.QueryContext(ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (db *timedDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, done := db.start(ctx, query)
+	row := db.DB.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+	return row
+}
+
+func (db *timedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*timedTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &timedTx{Tx: tx, db: db}, nil
+}
+
+// start opens a span for a query and returns the func that records its
+// outcome once it has run.
+func (db *timedDB) start(ctx context.Context, query string) (context.Context, func(error)) {
+	method := callerMethod()
+	ctx, span := tracer.Start(ctx, "db."+method, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "sqlite"),
+			attribute.String("db.operation.name", method),
+			attribute.String("db.query.text", strings.Join(strings.Fields(query), " ")),
+		))
+	start := time.Now()
+	return ctx, func(err error) {
+		if err == sql.ErrNoRows {
+			err = nil
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		if db.observe != nil {
+			db.observe(method, time.Since(start), err)
+		}
+	}
+}
+
+type timedTx struct {
+	*sql.Tx
+	db *timedDB
+}
+
+func (tx *timedTx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, done := tx.db.start(ctx, query)
+	result, err := tx.Tx.ExecContext(ctx, query, args...)
+	done(err)
+	return result, err
+}
+
+func (tx *timedTx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, done := tx.db.start(ctx, query)
+	rows, err := tx.Tx.QueryContext(ctx, query, args...)
+	done(err)
+	return rows, err
+}
+
+func (tx *timedTx) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, done := tx.db.start(ctx, query)
+	row := tx.Tx.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+	return row
+}
+
+// callerMethod finds the exported Client method on the stack, skipping
+// unexported helpers like queryVideos so queries are labelled by the
+// operation that ran them.
+func callerMethod() string {
+	pcs := make([]uintptr, 16)
+	n := runtime.Callers(4, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	fallback := "unknown"
+	for {
+		frame, more := frames.Next()
+		if !strings.Contains(frame.Function, "/internal/database.") {
+			break
+		}
+		name := frame.Function[strings.LastIndex(frame.Function, ".")+1:]
+		if name != "" && unicode.IsUpper(rune(name[0])) {
+			return name
+		}
+		if fallback == "unknown" {
+			fallback = name
+		}
+		if !more {
+			break
+		}
+	}
+	return fallback
+}
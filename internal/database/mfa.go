@@ -0,0 +1,158 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserTOTP struct {
+	UserID       uuid.UUID
+	Secret       string
+	CreatedAt    time.Time
+	EnabledAt    *time.Time
+	LastUsedStep int64
+}
+
+// SetPendingUserTOTP stores a new secret for a user that hasn't been
+// confirmed with a code yet. It replaces any earlier unconfirmed secret.
+func (c Client) SetPendingUserTOTP(ctx context.Context, userID uuid.UUID, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret, created_at, enabled_at, last_used_step)
+		VALUES (?, ?, CURRENT_TIMESTAMP, NULL, 0)
+		ON CONFLICT(user_id) DO UPDATE SET
+			secret = excluded.secret,
+			created_at = excluded.created_at,
+			enabled_at = NULL,
+			last_used_step = 0
+		WHERE user_totp.enabled_at IS NULL
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String(), secret)
+	return err
+}
+
+func (c Client) GetUserTOTP(ctx context.Context, userID uuid.UUID) (UserTOTP, error) {
+	query := `
+		SELECT user_id, secret, created_at, enabled_at, last_used_step
+		FROM user_totp
+		WHERE user_id = ?
+	`
+	var totp UserTOTP
+	var id string
+	err := c.db.QueryRowContext(ctx, query, userID.String()).
+		Scan(&id, &totp.Secret, &totp.CreatedAt, &totp.EnabledAt, &totp.LastUsedStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserTOTP{}, nil
+		}
+		return UserTOTP{}, err
+	}
+	totp.UserID, err = uuid.Parse(id)
+	if err != nil {
+		return UserTOTP{}, err
+	}
+	return totp, nil
+}
+
+func (c Client) EnableUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE user_totp
+		SET enabled_at = CURRENT_TIMESTAMP
+		WHERE user_id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String())
+	return err
+}
+
+// UseTOTPStep records that the code for step was used. It returns false if
+// that step, or a later one, was already used, which stops a code from being
+// replayed within its validity window.
+func (c Client) UseTOTPStep(ctx context.Context, userID uuid.UUID, step int64) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET last_used_step = ?
+		WHERE user_id = ? AND last_used_step < ?
+	`
+	result, err := c.db.ExecContext(ctx, query, step, userID.String(), step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (c Client) DeleteUserTOTP(ctx context.Context, userID uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = ?`, userID.String()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes swaps all of a user's recovery codes for a new set of
+// hashed codes.
+func (c Client) ReplaceRecoveryCodes(ctx context.Context, userID uuid.UUID, codeHashes []string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID.String()); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		query := `
+			INSERT INTO recovery_codes (code_hash, user_id, created_at)
+			VALUES (?, ?, CURRENT_TIMESTAMP)
+		`
+		if _, err := tx.ExecContext(ctx, query, hash, userID.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ConsumeRecoveryCode marks an unused recovery code as used and reports
+// whether it was valid.
+func (c Client) ConsumeRecoveryCode(ctx context.Context, userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+	result, err := c.db.ExecContext(ctx, query, userID.String(), codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (c Client) CountUnusedRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM recovery_codes
+		WHERE user_id = ? AND used_at IS NULL
+	`
+	var count int
+	err := c.db.QueryRowContext(ctx, query, userID.String()).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type OIDCLoginState struct {
+	State        string    `json:"state"`
+	Nonce        string    `json:"nonce"`
+	CodeVerifier string    `json:"code_verifier"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (c Client) CreateOIDCLoginState(ctx context.Context, state OIDCLoginState) error {
+	query := `
+		INSERT INTO oidc_login_states (state, nonce, code_verifier, created_at, expires_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, state.State, state.Nonce, state.CodeVerifier, state.ExpiresAt)
+	return err
+}
+
+// ConsumeOIDCLoginState returns the login state and deletes it so a callback
+// can't be replayed. It also clears out any expired states.
+func (c Client) ConsumeOIDCLoginState(ctx context.Context, state string) (OIDCLoginState, error) {
+	query := `
+		DELETE FROM oidc_login_states
+		WHERE state = ?
+		RETURNING state, nonce, code_verifier, created_at, expires_at
+	`
+	var s OIDCLoginState
+	err := c.db.QueryRowContext(ctx, query, state).Scan(&s.State, &s.Nonce, &s.CodeVerifier, &s.CreatedAt, &s.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OIDCLoginState{}, nil
+		}
+		return OIDCLoginState{}, err
+	}
+
+	_, err = c.db.ExecContext(ctx, `DELETE FROM oidc_login_states WHERE expires_at < ?`, time.Now().UTC())
+	if err != nil {
+		return OIDCLoginState{}, err
+	}
+	return s, nil
+}
+
+func (c Client) GetUserIdentity(ctx context.Context, issuer, subject string) (UserIdentity, error) {
+	query := `
+		SELECT issuer, subject, user_id, email, created_at
+		FROM user_identities
+		WHERE issuer = ? AND subject = ?
+	`
+	var identity UserIdentity
+	var userID string
+	err := c.db.QueryRowContext(ctx, query, issuer, subject).
+		Scan(&identity.Issuer, &identity.Subject, &userID, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserIdentity{}, nil
+		}
+		return UserIdentity{}, err
+	}
+	identity.UserID, err = uuid.Parse(userID)
+	if err != nil {
+		return UserIdentity{}, err
+	}
+	return identity, nil
+}
+
+func (c Client) CreateUserIdentity(ctx context.Context, identity UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+		VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.ExecContext(ctx, query, identity.Issuer, identity.Subject, identity.UserID.String(), identity.Email)
+	return err
+}
@@ -1,6 +1,7 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"time"
 
@@ -20,7 +21,7 @@ type CreateRefreshTokenParams struct {
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
-func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
+func (c Client) CreateRefreshToken(ctx context.Context, params CreateRefreshTokenParams) (RefreshToken, error) {
 	query := `
 		INSERT INTO refresh_tokens (
 			token,
@@ -30,25 +31,37 @@ func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToke
 			expires_at
 		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.db.ExecContext(ctx, query, params.Token, params.UserID.String(), params.ExpiresAt)
 	if err != nil {
 		return RefreshToken{}, err
 	}
 
-	return c.GetRefreshToken(params.Token)
+	return c.GetRefreshToken(ctx, params.Token)
 }
 
-func (c Client) RevokeRefreshToken(token string) error {
+func (c Client) RevokeRefreshToken(ctx context.Context, token string) error {
 	query := `
 		UPDATE refresh_tokens
 		SET revoked_at = CURRENT_TIMESTAMP
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(ctx, query, token)
 	return err
 }
 
-func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
+// RevokeUserRefreshTokens revokes every active refresh token belonging to a
+// user, signing them out everywhere.
+func (c Client) RevokeUserRefreshTokens(ctx context.Context, userID uuid.UUID) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String())
+	return err
+}
+
+func (c Client) GetRefreshToken(ctx context.Context, token string) (RefreshToken, error) {
 	query := `
 		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
 		FROM refresh_tokens
@@ -56,7 +69,7 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	`
 	var rt RefreshToken
 	var userID string
-	err := c.db.QueryRow(query, token).
+	err := c.db.QueryRowContext(ctx, query, token).
 		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -73,11 +86,11 @@ func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	return rt, nil
 }
 
-func (c Client) DeleteRefreshToken(token string) error {
+func (c Client) DeleteRefreshToken(ctx context.Context, token string) error {
 	query := `
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(ctx, query, token)
 	return err
 }
@@ -0,0 +1,180 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ShareLink struct {
+	ID           uuid.UUID  `json:"id"`
+	TokenHash    string     `json:"-"`
+	VideoID      uuid.UUID  `json:"video_id"`
+	UserID       uuid.UUID  `json:"user_id"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    *time.Time `json:"expires_at"`
+	PasswordHash *string    `json:"-"`
+	HasPassword  bool       `json:"has_password"`
+	MaxViews     *int       `json:"max_views"`
+	ViewCount    int        `json:"view_count"`
+	RevokedAt    *time.Time `json:"revoked_at"`
+}
+
+type CreateShareLinkParams struct {
+	TokenHash    string
+	VideoID      uuid.UUID
+	UserID       uuid.UUID
+	ExpiresAt    *time.Time
+	PasswordHash *string
+	MaxViews     *int
+}
+
+const shareLinkColumns = `
+		id,
+		token_hash,
+		video_id,
+		user_id,
+		created_at,
+		expires_at,
+		password_hash,
+		max_views,
+		view_count,
+		revoked_at`
+
+func scanShareLink(row rowScanner) (ShareLink, error) {
+	var link ShareLink
+	err := row.Scan(
+		&link.ID,
+		&link.TokenHash,
+		&link.VideoID,
+		&link.UserID,
+		&link.CreatedAt,
+		&link.ExpiresAt,
+		&link.PasswordHash,
+		&link.MaxViews,
+		&link.ViewCount,
+		&link.RevokedAt,
+	)
+	link.HasPassword = link.PasswordHash != nil
+	return link, err
+}
+
+func (c Client) CreateShareLink(ctx context.Context, params CreateShareLinkParams) (ShareLink, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO share_links (
+		id,
+		token_hash,
+		video_id,
+		user_id,
+		created_at,
+		expires_at,
+		password_hash,
+		max_views,
+		view_count
+	) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?, ?, 0)
+	`
+	_, err := c.db.ExecContext(ctx,
+		query,
+		id,
+		params.TokenHash,
+		params.VideoID,
+		params.UserID,
+		params.ExpiresAt,
+		params.PasswordHash,
+		params.MaxViews,
+	)
+	if err != nil {
+		return ShareLink{}, err
+	}
+	return c.GetShareLink(ctx, id)
+}
+
+func (c Client) GetShareLink(ctx context.Context, id uuid.UUID) (ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE id = ?
+	`
+	link, err := scanShareLink(c.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (c Client) GetShareLinkByTokenHash(ctx context.Context, tokenHash string) (ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE token_hash = ?
+	`
+	link, err := scanShareLink(c.db.QueryRowContext(ctx, query, tokenHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ShareLink{}, nil
+		}
+		return ShareLink{}, err
+	}
+	return link, nil
+}
+
+func (c Client) GetShareLinks(ctx context.Context, videoID uuid.UUID) ([]ShareLink, error) {
+	query := `
+	SELECT` + shareLinkColumns + `
+	FROM share_links
+	WHERE video_id = ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(ctx, query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []ShareLink{}
+	for rows.Next() {
+		link, err := scanShareLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+func (c Client) RevokeShareLink(ctx context.Context, id uuid.UUID) error {
+	query := `
+	UPDATE share_links
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND revoked_at IS NULL
+	`
+	_, err := c.db.ExecContext(ctx, query, id)
+	return err
+}
+
+// RecordShareLinkView counts a view of a share link. It returns false without
+// counting if the link has already reached its view limit, so concurrent
+// requests can't go over it.
+func (c Client) RecordShareLinkView(ctx context.Context, id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE share_links
+	SET view_count = view_count + 1
+	WHERE id = ? AND (max_views IS NULL OR view_count < max_views)
+	`
+	result, err := c.db.ExecContext(ctx, query, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
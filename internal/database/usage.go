@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UserUsage is what a user currently has stored. Every version of every
+// video counts, including files shared with other uploads through
+// deduplication.
+type UserUsage struct {
+	UserID     uuid.UUID `json:"user_id"`
+	BytesUsed  int64     `json:"bytes_used"`
+	VideoCount int       `json:"video_count"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// UserQuota overrides the default limits for a user. A nil limit falls back
+// to the default and 0 means unlimited.
+type UserQuota struct {
+	UserID    uuid.UUID `json:"user_id"`
+	MaxBytes  *int64    `json:"max_bytes"`
+	MaxVideos *int      `json:"max_videos"`
+}
+
+func (c Client) GetUserUsage(ctx context.Context, userID uuid.UUID) (UserUsage, error) {
+	query := `
+	SELECT user_id, bytes_used, video_count, updated_at
+	FROM user_usage
+	WHERE user_id = ?
+	`
+	var usage UserUsage
+	err := c.db.QueryRowContext(ctx, query, userID).Scan(&usage.UserID, &usage.BytesUsed, &usage.VideoCount, &usage.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserUsage{UserID: userID}, nil
+	}
+	return usage, err
+}
+
+func (c Client) GetUserQuota(ctx context.Context, userID uuid.UUID) (UserQuota, error) {
+	query := `
+	SELECT user_id, max_bytes, max_videos
+	FROM user_quotas
+	WHERE user_id = ?
+	`
+	var quota UserQuota
+	err := c.db.QueryRowContext(ctx, query, userID).Scan(&quota.UserID, &quota.MaxBytes, &quota.MaxVideos)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserQuota{UserID: userID}, nil
+	}
+	return quota, err
+}
+
+func (c Client) SetUserQuota(ctx context.Context, quota UserQuota) error {
+	query := `
+	INSERT INTO user_quotas (user_id, max_bytes, max_videos, updated_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT(user_id) DO UPDATE SET
+		max_bytes = excluded.max_bytes,
+		max_videos = excluded.max_videos,
+		updated_at = excluded.updated_at
+	`
+	_, err := c.db.ExecContext(ctx, query, quota.UserID, quota.MaxBytes, quota.MaxVideos)
+	return err
+}
+
+// addVideoUsage adjusts the usage of the user owning a video. It has to run
+// in the same transaction as the change it accounts for, and before the
+// video row is deleted.
+func addVideoUsage(ctx context.Context, tx *timedTx, videoID uuid.UUID, bytes int64, videos int) error {
+	query := `
+	INSERT INTO user_usage (user_id, bytes_used, video_count, updated_at)
+	SELECT user_id, ?, ?, CURRENT_TIMESTAMP FROM videos WHERE id = ?
+	ON CONFLICT(user_id) DO UPDATE SET
+		bytes_used = bytes_used + excluded.bytes_used,
+		video_count = video_count + excluded.video_count,
+		updated_at = excluded.updated_at
+	`
+	_, err := tx.ExecContext(ctx, query, bytes, videos, videoID)
+	return err
+}
+
+// backfillUserUsage computes usage for users who have none recorded yet,
+// which after an upgrade is everyone with videos.
+func (c Client) backfillUserUsage() error {
+	query := `
+	INSERT OR IGNORE INTO user_usage (user_id, bytes_used, video_count, updated_at)
+	SELECT
+		v.user_id,
+		COALESCE((
+			SELECT SUM(COALESCE(vv.size_bytes, 0))
+			FROM video_versions vv
+			JOIN videos owned ON owned.id = vv.video_id
+			WHERE owned.user_id = v.user_id
+		), 0),
+		COUNT(*),
+		CURRENT_TIMESTAMP
+	FROM videos v
+	GROUP BY v.user_id
+	`
+	_, err := c.db.Exec(query)
+	return err
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserTokenPurpose string
+
+const (
+	UserTokenPurposeVerifyEmail   UserTokenPurpose = "verify_email"
+	UserTokenPurposePasswordReset UserTokenPurpose = "password_reset"
+	// UserTokenPurposeCancelDeletion tokens undo a scheduled account deletion
+	UserTokenPurposeCancelDeletion UserTokenPurpose = "cancel_deletion"
+	// UserTokenPurposeConfirmDeletion tokens confirm a deletion requested
+	// without a password
+	UserTokenPurposeConfirmDeletion UserTokenPurpose = "confirm_deletion"
+	// UserTokenPurposeOIDCLogin tokens are swapped by the app for a session
+	// after an OIDC login
+	UserTokenPurposeOIDCLogin UserTokenPurpose = "oidc_login"
+)
+
+type CreateUserTokenParams struct {
+	TokenHash string
+	UserID    uuid.UUID
+	Purpose   UserTokenPurpose
+	ExpiresAt time.Time
+}
+
+func (c Client) CreateUserToken(ctx context.Context, params CreateUserTokenParams) error {
+	query := `
+		INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.ExecContext(ctx, query, params.TokenHash, params.UserID.String(), params.Purpose, params.ExpiresAt)
+	return err
+}
+
+// ConsumeUserToken marks an unused, unexpired token as used and returns the
+// user it belongs to. It returns uuid.Nil if no such token exists, so each
+// token works exactly once.
+func (c Client) ConsumeUserToken(ctx context.Context, tokenHash string, purpose UserTokenPurpose) (uuid.UUID, error) {
+	query := `
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?
+		RETURNING user_id
+	`
+	var userID string
+	err := c.db.QueryRowContext(ctx, query, tokenHash, purpose, time.Now().UTC()).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil
+		}
+		return uuid.Nil, err
+	}
+	return uuid.Parse(userID)
+}
+
+// InvalidateUserTokens marks all of a user's outstanding tokens for a purpose
+// as used, e.g. older reset links once the password has been changed.
+func (c Client) InvalidateUserTokens(ctx context.Context, userID uuid.UUID, purpose UserTokenPurpose) error {
+	query := `
+		UPDATE user_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND purpose = ? AND used_at IS NULL
+	`
+	_, err := c.db.ExecContext(ctx, query, userID.String(), purpose)
+	return err
+}
@@ -1,17 +1,20 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID              uuid.UUID  `json:"id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
 	CreateUserParams
 }
 
@@ -20,7 +23,7 @@ type CreateUserParams struct {
 	Password string `json:"password"`
 }
 
-func (c Client) GetUsers() ([]User, error) {
+func (c Client) GetUsers(ctx context.Context) ([]User, error) {
 	query := `
 		SELECT
 			id,
@@ -28,7 +31,7 @@ func (c Client) GetUsers() ([]User, error) {
 		FROM users
 	`
 
-	rows, err := c.db.Query(query)
+	rows, err := c.db.QueryContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
@@ -51,15 +54,15 @@ func (c Client) GetUsers() ([]User, error) {
 	return users, nil
 }
 
-func (c Client) GetUserByEmail(email string) (User, error) {
+func (c Client) GetUserByEmail(ctx context.Context, email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, email_verified_at
 		FROM users
 		WHERE email = ?
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
@@ -73,17 +76,19 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
-func (c Client) GetUserByRefreshToken(token string) (*User, error) {
+// GetUserByRefreshToken returns the user a refresh token belongs to, or nil if
+// the token is unknown, revoked or expired.
+func (c Client) GetUserByRefreshToken(ctx context.Context, token string) (*User, error) {
 	query := `
-		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
+		SELECT u.id, u.email, u.created_at, u.updated_at, u.password, u.email_verified_at
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
+		WHERE rt.token = ? AND rt.revoked_at IS NULL AND rt.expires_at > ?
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -98,7 +103,7 @@ func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	return &user, nil
 }
 
-func (c Client) CreateUser(params CreateUserParams) (*User, error) {
+func (c Client) CreateUser(ctx context.Context, params CreateUserParams) (*User, error) {
 	id := uuid.New()
 
 	query := `
@@ -107,23 +112,23 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 		VALUES
 		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.ExecContext(ctx, query, id.String(), params.Email, params.Password)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.GetUser(id)
+	return c.GetUser(ctx, id)
 }
 
-func (c Client) GetUser(id uuid.UUID) (*User, error) {
+func (c Client) GetUser(ctx context.Context, id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, email_verified_at
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.EmailVerifiedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -137,11 +142,295 @@ func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	return &user, nil
 }
 
-func (c Client) DeleteUser(id uuid.UUID) error {
+func (c Client) MarkUserEmailVerified(ctx context.Context, id uuid.UUID) error {
 	query := `
-		DELETE FROM users
+		UPDATE users
+		SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email_verified_at IS NULL
+	`
+	_, err := c.db.ExecContext(ctx, query, id.String())
+	return err
+}
+
+func (c Client) UpdateUserPassword(ctx context.Context, id uuid.UUID, hashedPassword string) error {
+	query := `
+		UPDATE users
+		SET password = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, hashedPassword, id.String())
+	return err
+}
+
+// RecordFailedLogin increments the user's consecutive failed login count and
+// returns the new count.
+func (c Client) RecordFailedLogin(ctx context.Context, id uuid.UUID) (int, error) {
+	query := `
+		UPDATE users
+		SET failed_login_count = failed_login_count + 1
+		WHERE id = ?
+		RETURNING failed_login_count
+	`
+	var count int
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(&count)
+	return count, err
+}
+
+func (c Client) ResetFailedLogins(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET failed_login_count = 0, locked_until = NULL
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, id.String())
+	return err
+}
+
+func (c Client) LockUser(ctx context.Context, id uuid.UUID, until time.Time) error {
+	query := `
+		UPDATE users
+		SET locked_until = ?
+		WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx, query, until, id.String())
+	return err
+}
+
+func (c Client) GetUserLockedUntil(ctx context.Context, id uuid.UUID) (*time.Time, error) {
+	query := `
+		SELECT locked_until
+		FROM users
+		WHERE id = ?
+	`
+	var lockedUntil *time.Time
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(&lockedUntil)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return lockedUntil, nil
+}
+
+// UserAccess is what decides whether a user's tokens are still accepted.
+type UserAccess struct {
+	DisabledAt *time.Time
+	// TokensRevokedAt invalidates every access token issued up to it
+	TokensRevokedAt *time.Time
+	// DeleteAfter is set while the user's account is scheduled for deletion
+	DeleteAfter *time.Time
+}
+
+func (c Client) GetUserAccess(ctx context.Context, id uuid.UUID) (UserAccess, error) {
+	query := `
+		SELECT disabled_at, tokens_revoked_at, delete_after
+		FROM users
+		WHERE id = ?
+	`
+	var access UserAccess
+	err := c.db.QueryRowContext(ctx, query, id.String()).Scan(&access.DisabledAt, &access.TokensRevokedAt, &access.DeleteAfter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserAccess{}, nil
+		}
+		return UserAccess{}, err
+	}
+	return access, nil
+}
+
+// DisableUser stops a user from signing in and signs them out everywhere.
+func (c Client) DisableUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP), updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, id.String()); err != nil {
+		return err
+	}
+	query = `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND revoked_at IS NULL
+	`
+	if _, err := tx.ExecContext(ctx, query, id.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c Client) EnableUser(ctx context.Context, id uuid.UUID) error {
+	query := `
+		UPDATE users
+		SET disabled_at = NULL, updated_at = CURRENT_TIMESTAMP
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.ExecContext(ctx, query, id.String())
 	return err
 }
+
+// RevokeUserTokens revokes a user's refresh tokens and every access token
+// issued to them so far.
+func (c Client) RevokeUserTokens(ctx context.Context, id uuid.UUID) error {
+	return c.revokeTokens(ctx, id.String())
+}
+
+// RevokeAllTokens signs every user out everywhere.
+func (c Client) RevokeAllTokens(ctx context.Context) error {
+	return c.revokeTokens(ctx, "")
+}
+
+// revokeTokens revokes the tokens of one user, or of all users if userID is
+// empty.
+func (c Client) revokeTokens(ctx context.Context, userID string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeTokensInTx(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func revokeTokensInTx(ctx context.Context, tx *timedTx, userID string) error {
+	// access tokens carry their issue time in whole seconds, so this is
+	// truncated to match. Tokens issued later in the same second are
+	// revoked too, which errs on the safe side.
+	now := time.Now().UTC().Truncate(time.Second)
+	query := `
+		UPDATE users
+		SET tokens_revoked_at = ?
+		WHERE ? = '' OR id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, now, userID, userID); err != nil {
+		return err
+	}
+	query = `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE revoked_at IS NULL AND (? = '' OR user_id = ?)
+	`
+	_, err := tx.ExecContext(ctx, query, userID, userID)
+	return err
+}
+
+// ScheduleUserDeletion marks a user's account to be deleted after
+// deleteAfter and signs them out everywhere. Until then it can be undone with
+// CancelUserDeletion.
+func (c Client) ScheduleUserDeletion(ctx context.Context, id uuid.UUID, deleteAfter time.Time) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET delete_after = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`
+	if _, err := tx.ExecContext(ctx, query, deleteAfter, id.String()); err != nil {
+		return err
+	}
+	if err := revokeTokensInTx(ctx, tx, id.String()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelUserDeletion unschedules a user's deletion and reports whether one
+// was scheduled.
+func (c Client) CancelUserDeletion(ctx context.Context, id uuid.UUID) (bool, error) {
+	query := `
+		UPDATE users
+		SET delete_after = NULL, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND delete_after IS NOT NULL
+	`
+	result, err := c.db.ExecContext(ctx, query, id.String())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetUsersDueForDeletion returns the IDs of users whose scheduled deletion is
+// due.
+func (c Client) GetUsersDueForDeletion(ctx context.Context, now time.Time) ([]uuid.UUID, error) {
+	query := `
+		SELECT id
+		FROM users
+		WHERE delete_after IS NOT NULL AND delete_after <= ?
+	`
+	rows, err := c.db.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		userID, err := uuid.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, userID)
+	}
+	return ids, rows.Err()
+}
+
+// DeleteUser deletes a user along with everything else stored about them.
+// Foreign keys aren't enforced, so nothing is removed implicitly. Videos own
+// files in storage, so they have to be deleted with DeleteVideo first, as
+// do the archives of the user's exports.
+func (c Client) DeleteUser(ctx context.Context, id uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var videoCount int
+	err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM videos WHERE user_id = ?`, id.String()).Scan(&videoCount)
+	if err != nil {
+		return err
+	}
+	if videoCount > 0 {
+		return fmt.Errorf("user still has %d videos", videoCount)
+	}
+
+	queries := []string{
+		`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE user_id = ?)`,
+		`DELETE FROM webhooks WHERE user_id = ?`,
+		`DELETE FROM share_links WHERE user_id = ?`,
+		`DELETE FROM exports WHERE user_id = ?`,
+		`DELETE FROM refresh_tokens WHERE user_id = ?`,
+		`DELETE FROM user_tokens WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+		`DELETE FROM user_totp WHERE user_id = ?`,
+		`DELETE FROM user_identities WHERE user_id = ?`,
+		`DELETE FROM user_usage WHERE user_id = ?`,
+		`DELETE FROM user_quotas WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, query := range queries {
+		if _, err := tx.ExecContext(ctx, query, id.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,523 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoVersion is one upload of a video's file. Uploading again adds a
+// version rather than replacing the file, so older ones can be rolled back
+// to until they're pruned.
+type VideoVersion struct {
+	ID              uuid.UUID `json:"id"`
+	VideoID         uuid.UUID `json:"video_id"`
+	Version         int       `json:"version"`
+	Bucket          string    `json:"-"`
+	Key             string    `json:"key"`
+	ContentType     *string   `json:"content_type"`
+	SizeBytes       *int64    `json:"size_bytes"`
+	AspectRatio     *string   `json:"aspect_ratio"`
+	DurationSeconds *float64  `json:"duration_seconds"`
+	UploadedBy      uuid.UUID `json:"uploaded_by"`
+	CreatedAt       time.Time `json:"created_at"`
+	// BlobSHA256 is the blob holding the file. Versions uploaded before
+	// deduplication own their object outright and have none.
+	BlobSHA256 *string `json:"sha256"`
+	// ChecksumSHA256 is the base64 SHA-256 of the stored object, which S3
+	// verified on upload. Audits compare it to what's in the bucket.
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+}
+
+// StorageURL is the "bucket,key" form stored in videos.video_url.
+func (v VideoVersion) StorageURL() string {
+	return v.Bucket + "," + v.Key
+}
+
+type CreateVideoVersionParams struct {
+	VideoID         uuid.UUID
+	Bucket          string
+	Key             string
+	ContentType     string
+	SizeBytes       int64
+	AspectRatio     string
+	DurationSeconds float64
+	UploadedBy      uuid.UUID
+	// SHA256 is the hash of the uploaded file. The object at Bucket and Key
+	// is stored as that blob, or another reference is added if it already
+	// exists.
+	SHA256 string
+	// ChecksumSHA256 is the base64 SHA-256 of the object as stored, which
+	// differs from SHA256 because the file is processed first.
+	ChecksumSHA256 string
+}
+
+const videoVersionColumns = `
+		id,
+		video_id,
+		version,
+		bucket,
+		key,
+		content_type,
+		size_bytes,
+		aspect_ratio,
+		duration_seconds,
+		uploaded_by,
+		created_at,
+		blob_sha256,
+		checksum_sha256`
+
+func scanVideoVersion(row rowScanner) (VideoVersion, error) {
+	var v VideoVersion
+	err := row.Scan(
+		&v.ID,
+		&v.VideoID,
+		&v.Version,
+		&v.Bucket,
+		&v.Key,
+		&v.ContentType,
+		&v.SizeBytes,
+		&v.AspectRatio,
+		&v.DurationSeconds,
+		&v.UploadedBy,
+		&v.CreatedAt,
+		&v.BlobSHA256,
+		&v.ChecksumSHA256,
+	)
+	return v, err
+}
+
+// CreateVideoVersion adds the next version of a video and makes it the
+// current one.
+func (c Client) CreateVideoVersion(ctx context.Context, params CreateVideoVersionParams) (VideoVersion, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	defer tx.Rollback()
+
+	blobQuery := `
+	INSERT INTO blobs (
+		sha256,
+		bucket,
+		key,
+		content_type,
+		size_bytes,
+		aspect_ratio,
+		duration_seconds,
+		checksum_sha256,
+		ref_count,
+		created_at
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, 1, CURRENT_TIMESTAMP)
+	ON CONFLICT(sha256) DO UPDATE SET ref_count = ref_count + 1
+	`
+	_, err = tx.ExecContext(ctx,
+		blobQuery,
+		params.SHA256,
+		params.Bucket,
+		params.Key,
+		params.ContentType,
+		params.SizeBytes,
+		params.AspectRatio,
+		params.DurationSeconds,
+		params.ChecksumSHA256,
+	)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+
+	id := uuid.New()
+	query := `
+	INSERT INTO video_versions (
+		id,
+		video_id,
+		version,
+		bucket,
+		key,
+		content_type,
+		size_bytes,
+		aspect_ratio,
+		duration_seconds,
+		uploaded_by,
+		created_at,
+		blob_sha256,
+		checksum_sha256
+	) VALUES (
+		?, ?,
+		(SELECT COALESCE(MAX(version), 0) + 1 FROM video_versions WHERE video_id = ?),
+		?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP, ?, ?
+	)
+	`
+	_, err = tx.ExecContext(ctx,
+		query,
+		id,
+		params.VideoID,
+		params.VideoID,
+		params.Bucket,
+		params.Key,
+		params.ContentType,
+		params.SizeBytes,
+		params.AspectRatio,
+		params.DurationSeconds,
+		params.UploadedBy,
+		params.SHA256,
+		params.ChecksumSHA256,
+	)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	if err := addVideoUsage(ctx, tx, params.VideoID, params.SizeBytes, 0); err != nil {
+		return VideoVersion{}, err
+	}
+
+	err = setCurrentVideoVersion(ctx, tx, params.VideoID, id, params.Bucket+","+params.Key)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return VideoVersion{}, err
+	}
+	return c.GetVideoVersion(ctx, id)
+}
+
+// CreateVideoVersionFromBlob adds a version of a video that reuses an
+// existing blob, copying its storage location and probe metadata, and makes
+// it the current one. It returns false if the blob doesn't exist or its last
+// reference is already gone, in which case the file has to be stored again.
+func (c Client) CreateVideoVersionFromBlob(ctx context.Context, videoID uuid.UUID, sha256 string, uploadedBy uuid.UUID) (VideoVersion, bool, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return VideoVersion{}, false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+	UPDATE blobs SET ref_count = ref_count + 1
+	WHERE sha256 = ? AND ref_count > 0
+	`, sha256)
+	if err != nil {
+		return VideoVersion{}, false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return VideoVersion{}, false, err
+	}
+
+	id := uuid.New()
+	query := `
+	INSERT INTO video_versions (
+		id,
+		video_id,
+		version,
+		bucket,
+		key,
+		content_type,
+		size_bytes,
+		aspect_ratio,
+		duration_seconds,
+		uploaded_by,
+		created_at,
+		blob_sha256,
+		checksum_sha256
+	)
+	SELECT
+		?, ?,
+		(SELECT COALESCE(MAX(version), 0) + 1 FROM video_versions WHERE video_id = ?),
+		bucket,
+		key,
+		content_type,
+		size_bytes,
+		aspect_ratio,
+		duration_seconds,
+		?, CURRENT_TIMESTAMP, sha256, checksum_sha256
+	FROM blobs
+	WHERE sha256 = ?
+	`
+	_, err = tx.ExecContext(ctx, query, id, videoID, videoID, uploadedBy, sha256)
+	if err != nil {
+		return VideoVersion{}, false, err
+	}
+
+	var size int64
+	err = tx.QueryRowContext(ctx, `SELECT size_bytes FROM blobs WHERE sha256 = ?`, sha256).Scan(&size)
+	if err != nil {
+		return VideoVersion{}, false, err
+	}
+	if err := addVideoUsage(ctx, tx, videoID, size, 0); err != nil {
+		return VideoVersion{}, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+	UPDATE videos
+	SET
+		current_version_id = ?,
+		video_url = (SELECT bucket || ',' || key FROM blobs WHERE sha256 = ?),
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`, id, sha256, videoID)
+	if err != nil {
+		return VideoVersion{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return VideoVersion{}, false, err
+	}
+
+	version, err := c.GetVideoVersion(ctx, id)
+	return version, err == nil, err
+}
+
+func (c Client) GetVideoVersion(ctx context.Context, id uuid.UUID) (VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE id = ?
+	`
+	v, err := scanVideoVersion(c.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return v, nil
+}
+
+// GetVideoVersions returns a video's versions, newest first.
+func (c Client) GetVideoVersions(ctx context.Context, videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY version DESC
+	`
+	return c.queryVideoVersions(ctx, query, videoID)
+}
+
+// GetAllVideoVersions returns the versions of every video, which is every
+// file that should be in storage.
+func (c Client) GetAllVideoVersions(ctx context.Context) ([]VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	ORDER BY video_id, version DESC
+	`
+	return c.queryVideoVersions(ctx, query)
+}
+
+func (c Client) queryVideoVersions(ctx context.Context, query string, args ...any) ([]VideoVersion, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		v, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// SetCurrentVideoVersion points the video at one of its versions.
+func (c Client) SetCurrentVideoVersion(ctx context.Context, version VideoVersion) error {
+	return setCurrentVideoVersion(ctx, c.db, version.VideoID, version.ID, version.StorageURL())
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func setCurrentVideoVersion(ctx context.Context, db execer, videoID, versionID uuid.UUID, storageURL string) error {
+	query := `
+	UPDATE videos
+	SET current_version_id = ?, video_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := db.ExecContext(ctx, query, versionID, storageURL, videoID)
+	return err
+}
+
+// StorageObject is an object nothing references any more, which the caller
+// should delete from storage.
+type StorageObject struct {
+	Bucket string
+	Key    string
+}
+
+// StorageObjectReferenced reports whether a blob or video version currently
+// points at the object.
+func (c Client) StorageObjectReferenced(ctx context.Context, object StorageObject) (bool, error) {
+	query := `
+	SELECT
+		EXISTS (SELECT 1 FROM blobs WHERE bucket = ? AND key = ?)
+		OR EXISTS (SELECT 1 FROM video_versions WHERE bucket = ? AND key = ?)
+	`
+	var referenced bool
+	err := c.db.QueryRowContext(ctx, query, object.Bucket, object.Key, object.Bucket, object.Key).Scan(&referenced)
+	return referenced, err
+}
+
+// MoveStorageBucket points every stored file recorded in bucket from at
+// bucket to, which holds the same keys, e.g. after restoring a backup
+// against a replica of the bucket.
+func (c Client) MoveStorageBucket(ctx context.Context, from, to string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"blobs", "video_versions", "exports"} {
+		query := fmt.Sprintf(`UPDATE %s SET bucket = ? WHERE bucket = ?`, table)
+		if _, err := tx.ExecContext(ctx, query, to, from); err != nil {
+			return err
+		}
+	}
+	query := `
+	UPDATE videos
+	SET video_url = ? || substr(video_url, length(?) + 1)
+	WHERE substr(video_url, 1, length(?)) = ?
+	`
+	prefix := from + ","
+	if _, err := tx.ExecContext(ctx, query, to+",", prefix, prefix, prefix); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteVideoVersion removes a version's record and releases its file. It
+// refuses to delete the video's current version. The returned object is
+// non-nil if this was the file's last reference.
+func (c Client) DeleteVideoVersion(ctx context.Context, id uuid.UUID) (*StorageObject, error) {
+	version, err := c.GetVideoVersion(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	DELETE FROM video_versions
+	WHERE id = ?
+	AND NOT EXISTS (SELECT 1 FROM videos WHERE current_version_id = ?)
+	`
+	result, err := tx.ExecContext(ctx, query, id, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n != 1 {
+		return nil, fmt.Errorf("video version %s is current or doesn't exist", id)
+	}
+	if version.SizeBytes != nil {
+		if err := addVideoUsage(ctx, tx, version.VideoID, -*version.SizeBytes, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	orphan, err := releaseVideoVersion(ctx, tx, version)
+	if err != nil {
+		return nil, err
+	}
+	return orphan, tx.Commit()
+}
+
+// releaseVideoVersion drops a deleted version's reference to its file and
+// returns the object if nothing references it any more.
+func releaseVideoVersion(ctx context.Context, tx *timedTx, version VideoVersion) (*StorageObject, error) {
+	if version.BlobSHA256 == nil {
+		return &StorageObject{Bucket: version.Bucket, Key: version.Key}, nil
+	}
+
+	_, err := tx.ExecContext(ctx, `UPDATE blobs SET ref_count = ref_count - 1 WHERE sha256 = ?`, *version.BlobSHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphan StorageObject
+	err = tx.QueryRowContext(ctx, `
+	DELETE FROM blobs
+	WHERE sha256 = ? AND ref_count <= 0
+	RETURNING bucket, key
+	`, *version.BlobSHA256).Scan(&orphan.Bucket, &orphan.Key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &orphan, nil
+}
+
+// backfillVideoVersions gives videos uploaded before versions existed a
+// first version for their current file.
+func (c Client) backfillVideoVersions() error {
+	rows, err := c.db.Query(`
+	SELECT id, user_id, video_url, updated_at
+	FROM videos
+	WHERE video_url IS NOT NULL AND video_url != '' AND current_version_id IS NULL
+	`)
+	if err != nil {
+		return err
+	}
+
+	type legacyVideo struct {
+		id, userID uuid.UUID
+		videoURL   string
+		updatedAt  time.Time
+	}
+	var videos []legacyVideo
+	for rows.Next() {
+		var v legacyVideo
+		if err := rows.Scan(&v.id, &v.userID, &v.videoURL, &v.updatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		videos = append(videos, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, v := range videos {
+		bucket, key, ok := strings.Cut(v.videoURL, ",")
+		if !ok {
+			// not a "bucket,key" URL, so there's no object to track
+			continue
+		}
+		tx, err := c.db.Begin()
+		if err != nil {
+			return err
+		}
+		versionID := uuid.New()
+		_, err = tx.Exec(`
+		INSERT INTO video_versions (id, video_id, version, bucket, key, uploaded_by, created_at)
+		VALUES (?, ?, 1, ?, ?, ?, ?)
+		`, versionID, v.id, bucket, key, v.userID, v.updatedAt)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE videos SET current_version_id = ? WHERE id = ?`, versionID, v.id)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("couldn't backfill version for video %s: %w", v.id, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,31 +1,74 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+type Visibility string
+
+const (
+	// VisibilityPrivate videos are only visible to their owner
+	VisibilityPrivate Visibility = "private"
+	// VisibilityUnlisted videos are visible to anyone with the link but are
+	// not listed in the public feed
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPublic   Visibility = "public"
+)
+
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return true
+	}
+	return false
+}
+
 type Video struct {
 	ID           uuid.UUID `json:"id"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
 	VideoURL     *string   `json:"video_url"`
+	// CurrentVersionID is the upload VideoURL points at
+	CurrentVersionID *uuid.UUID `json:"current_version_id"`
 	CreateVideoParams
 }
 
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	UserID      uuid.UUID  `json:"user_id"`
+	Visibility  Visibility `json:"visibility"`
+	// PublishAt makes the video public at that time. Until then it's
+	// treated as private whatever its visibility.
+	PublishAt *time.Time `json:"publish_at"`
+	// UnpublishAt makes the video private at that time.
+	UnpublishAt *time.Time `json:"unpublish_at"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+// EffectiveVisibility applies the publishing window to the stored
+// visibility. The scheduler eventually writes the same result back, this
+// keeps reads correct in between its runs.
+func (v Video) EffectiveVisibility(now time.Time) Visibility {
+	if v.UnpublishAt != nil && !now.Before(*v.UnpublishAt) {
+		return VisibilityPrivate
+	}
+	if v.PublishAt != nil {
+		if now.Before(*v.PublishAt) {
+			return VisibilityPrivate
+		}
+		return VisibilityPublic
+	}
+	return v.Visibility
+}
+
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
@@ -33,13 +76,37 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		description,
 		thumbnail_url,
 		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+		user_id,
+		visibility,
+		publish_at,
+		unpublish_at,
+		current_version_id`
 
-	rows, err := c.db.Query(query, userID)
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanVideo(row rowScanner) (Video, error) {
+	var video Video
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.Visibility,
+		&video.PublishAt,
+		&video.UnpublishAt,
+		&video.CurrentVersionID,
+	)
+	return video, err
+}
+
+func (c Client) queryVideos(ctx context.Context, query string, args ...any) ([]Video, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -47,26 +114,113 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
 }
 
-func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
+func (c Client) GetVideos(ctx context.Context, userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(ctx, query, userID)
+}
+
+// GetAllVideos returns every user's videos, newest first.
+func (c Client) GetAllVideos(ctx context.Context) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(ctx, query)
+}
+
+// GetPublicVideos returns a page of videos that are public right now, newest
+// first. It matches Video.EffectiveVisibility.
+func (c Client) GetPublicVideos(ctx context.Context, limit, offset int) ([]Video, error) {
+	now := time.Now().UTC()
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE (unpublish_at IS NULL OR unpublish_at > ?)
+	AND (
+		(publish_at IS NOT NULL AND publish_at <= ?)
+		OR (publish_at IS NULL AND visibility = ?)
+	)
+	ORDER BY COALESCE(publish_at, created_at) DESC
+	LIMIT ? OFFSET ?
+	`
+	return c.queryVideos(ctx, query, now, now, VisibilityPublic, limit, offset)
+}
+
+// GetVideosDueForScheduleChange returns videos whose publish or unpublish
+// time has passed.
+func (c Client) GetVideosDueForScheduleChange(ctx context.Context, now time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE publish_at <= ? OR unpublish_at <= ?
+	`
+	return c.queryVideos(ctx, query, now, now)
+}
+
+// PublishScheduledVideo makes a video public and clears its publish time if
+// that time has passed. It returns false if another run already did.
+func (c Client) PublishScheduledVideo(ctx context.Context, id uuid.UUID, now time.Time) (bool, error) {
+	query := `
+	UPDATE videos
+	SET visibility = ?, publish_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND publish_at <= ?
+	`
+	return c.execAffectsOne(ctx, query, VisibilityPublic, id, now)
+}
+
+// UnpublishScheduledVideo makes a video private and clears its unpublish
+// time if that time has passed.
+func (c Client) UnpublishScheduledVideo(ctx context.Context, id uuid.UUID, now time.Time) (bool, error) {
+	query := `
+	UPDATE videos
+	SET visibility = ?, unpublish_at = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND unpublish_at <= ?
+	`
+	return c.execAffectsOne(ctx, query, VisibilityPrivate, id, now)
+}
+
+func (c Client) execAffectsOne(ctx context.Context, query string, args ...any) (bool, error) {
+	result, err := c.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (c Client) CreateVideo(ctx context.Context, params CreateVideoParams) (Video, error) {
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPrivate
+	}
+	if !params.Visibility.Valid() {
+		return Video{}, fmt.Errorf("invalid visibility %q", params.Visibility)
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Video{}, err
+	}
+	defer tx.Rollback()
+
 	id := uuid.New()
 	query := `
 	INSERT INTO videos (
@@ -75,42 +229,43 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility,
+		publish_at,
+		unpublish_at
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	_, err = tx.ExecContext(ctx,
+		query,
+		id,
+		params.Title,
+		params.Description,
+		params.UserID,
+		params.Visibility,
+		params.PublishAt,
+		params.UnpublishAt,
+	)
 	if err != nil {
 		return Video{}, err
 	}
+	if err := addVideoUsage(ctx, tx, id, 0, 1); err != nil {
+		return Video{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Video{}, err
+	}
 
-	return c.GetVideo(id)
+	return c.GetVideo(ctx, id)
 }
 
-func (c Client) GetVideo(id uuid.UUID) (Video, error) {
+func (c Client) GetVideo(ctx context.Context, id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -121,7 +276,11 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
-func (c Client) UpdateVideo(video Video) error {
+func (c Client) UpdateVideo(ctx context.Context, video Video) error {
+	if !video.Visibility.Valid() {
+		return fmt.Errorf("invalid visibility %q", video.Visibility)
+	}
+
 	query := `
 	UPDATE videos
 	SET
@@ -129,27 +288,74 @@ func (c Client) UpdateVideo(video Video) error {
 		description = ?,
 		thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		user_id = ?,
+		visibility = ?,
+		publish_at = ?,
+		unpublish_at = ?,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	_, err := c.db.ExecContext(ctx,
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
 		&video.VideoURL,
 		video.UserID,
+		video.Visibility,
+		video.PublishAt,
+		video.UnpublishAt,
 		video.ID,
 	)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
-	query := `
-	DELETE FROM videos
-	WHERE id = ?
-	`
-	_, err := c.db.Exec(query, id)
-	return err
+// DeleteVideo deletes a video with its share links and versions. It returns
+// the stored files that are no longer referenced by any video, which the
+// caller should delete from storage.
+func (c Client) DeleteVideo(ctx context.Context, id uuid.UUID) ([]StorageObject, error) {
+	versions, err := c.GetVideoVersions(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var bytes int64
+	for _, version := range versions {
+		if version.SizeBytes != nil {
+			bytes += *version.SizeBytes
+		}
+	}
+	if err := addVideoUsage(ctx, tx, id, -bytes, -1); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM share_links WHERE video_id = ?`, id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM video_versions WHERE video_id = ?`, id); err != nil {
+		return nil, err
+	}
+
+	orphans := []StorageObject{}
+	for _, version := range versions {
+		orphan, err := releaseVideoVersion(ctx, tx, version)
+		if err != nil {
+			return nil, err
+		}
+		if orphan != nil {
+			orphans = append(orphans, *orphan)
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM videos WHERE id = ?`, id); err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
 }
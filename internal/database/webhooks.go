@@ -0,0 +1,312 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Webhook struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type CreateWebhookParams struct {
+	UserID uuid.UUID
+	URL    string
+	Secret string
+	Events []string
+}
+
+type DeliveryStatus string
+
+const (
+	DeliveryStatusPending   DeliveryStatus = "pending"
+	DeliveryStatusSucceeded DeliveryStatus = "succeeded"
+	DeliveryStatusFailed    DeliveryStatus = "failed"
+)
+
+type WebhookDelivery struct {
+	ID             uuid.UUID      `json:"id"`
+	WebhookID      uuid.UUID      `json:"webhook_id"`
+	EventID        uuid.UUID      `json:"event_id"`
+	EventType      string         `json:"event_type"`
+	Payload        string         `json:"payload"`
+	Status         DeliveryStatus `json:"status"`
+	Attempts       int            `json:"attempts"`
+	NextAttemptAt  *time.Time     `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time     `json:"last_attempt_at"`
+	ResponseStatus *int           `json:"response_status"`
+	LastError      *string        `json:"last_error"`
+	CreatedAt      time.Time      `json:"created_at"`
+	DeliveredAt    *time.Time     `json:"delivered_at"`
+}
+
+const webhookColumns = `
+		id,
+		user_id,
+		url,
+		secret,
+		events,
+		created_at`
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var webhook Webhook
+	var events string
+	err := row.Scan(
+		&webhook.ID,
+		&webhook.UserID,
+		&webhook.URL,
+		&webhook.Secret,
+		&events,
+		&webhook.CreatedAt,
+	)
+	webhook.Events = strings.Split(events, ",")
+	return webhook, err
+}
+
+func (c Client) queryWebhooks(ctx context.Context, query string, args ...any) ([]Webhook, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (c Client) CreateWebhook(ctx context.Context, params CreateWebhookParams) (Webhook, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO webhooks (id, user_id, url, secret, events, created_at)
+	VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err := c.db.ExecContext(ctx, query, id, params.UserID, params.URL, params.Secret, strings.Join(params.Events, ","))
+	if err != nil {
+		return Webhook{}, err
+	}
+	return c.GetWebhook(ctx, id)
+}
+
+func (c Client) GetWebhook(ctx context.Context, id uuid.UUID) (Webhook, error) {
+	query := `
+	SELECT` + webhookColumns + `
+	FROM webhooks
+	WHERE id = ?
+	`
+	webhook, err := scanWebhook(c.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Webhook{}, nil
+		}
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+func (c Client) GetWebhooks(ctx context.Context, userID uuid.UUID) ([]Webhook, error) {
+	query := `
+	SELECT` + webhookColumns + `
+	FROM webhooks
+	WHERE user_id = ?
+	ORDER BY created_at DESC
+	`
+	return c.queryWebhooks(ctx, query, userID)
+}
+
+func (c Client) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// EnqueueWebhookDeliveries writes a pending delivery of the payload for every
+// webhook of the user subscribed to the event type, in one transaction.
+func (c Client) EnqueueWebhookDeliveries(ctx context.Context, userID, eventID uuid.UUID, eventType, payload string) error {
+	webhooks, err := c.GetWebhooks(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	for _, webhook := range webhooks {
+		if !subscribed(webhook.Events, eventType) {
+			continue
+		}
+		query := `
+		INSERT INTO webhook_deliveries (
+			id,
+			webhook_id,
+			event_id,
+			event_type,
+			payload,
+			status,
+			attempts,
+			next_attempt_at,
+			created_at
+		) VALUES (?, ?, ?, ?, ?, ?, 0, ?, CURRENT_TIMESTAMP)
+		`
+		_, err := tx.ExecContext(ctx, query, uuid.New(), webhook.ID, eventID, eventType, payload, DeliveryStatusPending, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func subscribed(events []string, eventType string) bool {
+	for _, e := range events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+const webhookDeliveryColumns = `
+		id,
+		webhook_id,
+		event_id,
+		event_type,
+		payload,
+		status,
+		attempts,
+		next_attempt_at,
+		last_attempt_at,
+		response_status,
+		last_error,
+		created_at,
+		delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(
+		&d.ID,
+		&d.WebhookID,
+		&d.EventID,
+		&d.EventType,
+		&d.Payload,
+		&d.Status,
+		&d.Attempts,
+		&d.NextAttemptAt,
+		&d.LastAttemptAt,
+		&d.ResponseStatus,
+		&d.LastError,
+		&d.CreatedAt,
+		&d.DeliveredAt,
+	)
+	return d, err
+}
+
+func (c Client) queryWebhookDeliveries(ctx context.Context, query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// GetDueWebhookDeliveries returns pending deliveries whose next attempt is
+// due, oldest first.
+func (c Client) GetDueWebhookDeliveries(ctx context.Context, now time.Time, limit int) ([]WebhookDelivery, error) {
+	query := `
+	SELECT` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE status = ? AND next_attempt_at <= ?
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+	return c.queryWebhookDeliveries(ctx, query, DeliveryStatusPending, now, limit)
+}
+
+func (c Client) GetWebhookDeliveries(ctx context.Context, webhookID uuid.UUID, limit int) ([]WebhookDelivery, error) {
+	query := `
+	SELECT` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE webhook_id = ?
+	ORDER BY created_at DESC
+	LIMIT ?
+	`
+	return c.queryWebhookDeliveries(ctx, query, webhookID, limit)
+}
+
+type WebhookDeliveryAttempt struct {
+	ID             uuid.UUID
+	Status         DeliveryStatus
+	AttemptedAt    time.Time
+	NextAttemptAt  *time.Time
+	ResponseStatus *int
+	Error          *string
+}
+
+func (c Client) RecordWebhookDeliveryAttempt(ctx context.Context, attempt WebhookDeliveryAttempt) error {
+	var deliveredAt *time.Time
+	if attempt.Status == DeliveryStatusSucceeded {
+		deliveredAt = &attempt.AttemptedAt
+	}
+	query := `
+	UPDATE webhook_deliveries
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		last_attempt_at = ?,
+		next_attempt_at = ?,
+		response_status = ?,
+		last_error = ?,
+		delivered_at = ?
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(ctx,
+		query,
+		attempt.Status,
+		attempt.AttemptedAt,
+		attempt.NextAttemptAt,
+		attempt.ResponseStatus,
+		attempt.Error,
+		deliveredAt,
+		attempt.ID,
+	)
+	return err
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Type string
+
+const (
+	VideoCreated     Type = "video.created"
+	VideoUploaded    Type = "video.uploaded"
+	VideoProcessed   Type = "video.processed"
+	VideoFailed      Type = "video.failed"
+	VideoDeleted     Type = "video.deleted"
+	VideoPublished   Type = "video.published"
+	VideoUnpublished Type = "video.unpublished"
+	ThumbnailUpdated Type = "thumbnail.updated"
+)
+
+// Types lists every event type, e.g. for validating webhook subscriptions.
+var Types = []Type{
+	VideoCreated,
+	VideoUploaded,
+	VideoProcessed,
+	VideoFailed,
+	VideoDeleted,
+	VideoPublished,
+	VideoUnpublished,
+	ThumbnailUpdated,
+}
+
+func (t Type) Valid() bool {
+	for _, known := range Types {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
+type Event struct {
+	ID         uuid.UUID `json:"id"`
+	Type       Type      `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	UserID     uuid.UUID `json:"user_id"`
+	VideoID    uuid.UUID `json:"video_id,omitempty"`
+	Data       any       `json:"data,omitempty"`
+}
+
+type Handler func(context.Context, Event)
+
+// Bus fans events out to every subscriber. Handlers run synchronously on the
+// publishing goroutine, so they must not block for long.
+type Bus struct {
+	mu       sync.RWMutex
+	handlers []Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+func (b *Bus) Subscribe(h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, h)
+}
+
+// Publish fills in the event ID and time if they're unset and delivers the
+// event to all subscribers.
+func (b *Bus) Publish(ctx context.Context, e Event) {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now().UTC()
+	}
+
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		h(ctx, e)
+	}
+}
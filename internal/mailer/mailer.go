@@ -0,0 +1,93 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as verification and password
+// reset messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+
+	addr := net.JoinHostPort(m.Host, m.Port)
+	err := smtp.SendMail(addr, auth, m.From, []string{msg.To}, formatMessage(m.From, msg))
+	if err != nil {
+		return fmt.Errorf("couldn't send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// LogMailer writes messages to a file, or to the log if Path is empty,
+// instead of sending them. It's meant for local development.
+type LogMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data := formatMessage(m.From, msg)
+	if m.Path == "" {
+		slog.InfoContext(ctx, "Mail", "to", msg.To, "subject", msg.Subject, "message", string(data))
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't open mail log %s: %w", m.Path, err)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\n\n", data)
+	return err
+}
+
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
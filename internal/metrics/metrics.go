@@ -0,0 +1,135 @@
+// Package metrics holds the Prometheus collectors Tubely exports on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tubely"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests, by route pattern.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	uploadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_size_bytes",
+		Help:      "Size of uploaded files.",
+		// 64KiB up to 16GiB
+		Buckets: prometheus.ExponentialBuckets(64<<10, 4, 10),
+	}, []string{"kind"})
+
+	mediaCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "media_command_duration_seconds",
+		Help:      "Time taken by ffprobe and ffmpeg runs.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"command"})
+
+	mediaCommandFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "media_command_failures_total",
+		Help:      "ffprobe and ffmpeg runs that failed.",
+	}, []string{"command"})
+
+	s3OperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_duration_seconds",
+		Help:      "Latency of S3 API requests, per attempt.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	s3OperationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_operation_errors_total",
+		Help:      "S3 API requests that failed, per attempt.",
+	}, []string{"operation"})
+
+	presignedURLs = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_presigned_urls_total",
+		Help:      "Presigned S3 URLs generated.",
+	})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Time taken by database queries, by client method.",
+		Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+	}, []string{"method"})
+
+	dbQueryErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "Database queries that returned an error.",
+	}, []string{"method"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		uploadSize,
+		mediaCommandDuration,
+		mediaCommandFailures,
+		s3OperationDuration,
+		s3OperationErrors,
+		presignedURLs,
+		dbQueryDuration,
+		dbQueryErrors,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+func ObserveHTTPRequest(route, method string, status int, d time.Duration) {
+	httpRequestDuration.WithLabelValues(route, method, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+// ObserveUpload records the size of an uploaded file, kind being "video" or
+// "thumbnail".
+func ObserveUpload(kind string, size int64) {
+	uploadSize.WithLabelValues(kind).Observe(float64(size))
+}
+
+func ObserveMediaCommand(command string, d time.Duration, err error) {
+	mediaCommandDuration.WithLabelValues(command).Observe(d.Seconds())
+	if err != nil {
+		mediaCommandFailures.WithLabelValues(command).Inc()
+	}
+}
+
+func ObserveS3Operation(operation string, d time.Duration, err error) {
+	s3OperationDuration.WithLabelValues(operation).Observe(d.Seconds())
+	if err != nil {
+		s3OperationErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func IncPresignedURLs() {
+	presignedURLs.Inc()
+}
+
+// ObserveDBQuery matches database.QueryObserver.
+func ObserveDBQuery(method string, d time.Duration, err error) {
+	dbQueryDuration.WithLabelValues(method).Observe(d.Seconds())
+	if err != nil {
+		dbQueryErrors.WithLabelValues(method).Inc()
+	}
+}
@@ -0,0 +1,83 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+)
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// publicKeys converts the signing keys in the set to the types the jwt
+// package verifies with. Keys of unknown types are skipped.
+func (s jsonWebKeySet) publicKeys() (map[string]interface{}, error) {
+	keys := map[string]interface{}{}
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.KeyType {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.KeyID, err)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.KeyID, err)
+			}
+			keys[k.KeyID] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			if k.Curve != "P-256" {
+				continue
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.KeyID, err)
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.KeyID, err)
+			}
+			keys[k.KeyID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		case "OKP":
+			if k.Curve != "Ed25519" {
+				continue
+			}
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: %w", k.KeyID, err)
+			}
+			if len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s: invalid Ed25519 key length", k.KeyID)
+			}
+			keys[k.KeyID] = ed25519.PublicKey(x)
+		}
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
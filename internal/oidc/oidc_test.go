@@ -0,0 +1,229 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc/oidctest"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testClientID    = "tubely"
+	testRedirectURL = "http://tubely.test/api/oidc/callback"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+	idp, err := oidctest.NewServer(testClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		HTTPClient:  idp.Client(),
+	})
+	return idp, provider
+}
+
+type loginRequest struct {
+	state, nonce, codeVerifier string
+}
+
+func newLoginRequest(t *testing.T) loginRequest {
+	t.Helper()
+	var req loginRequest
+	for _, v := range []*string{&req.state, &req.nonce, &req.codeVerifier} {
+		s, err := oidc.NewRandomString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		*v = s
+	}
+	return req
+}
+
+// authorize sends the user through the provider and returns the query the
+// callback would receive.
+func authorize(t *testing.T, idp *oidctest.Server, provider *oidc.Provider, req loginRequest) url.Values {
+	t.Helper()
+	authURL, err := provider.AuthCodeURL(context.Background(), req.state, req.nonce, req.codeVerifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	redirect, err := idp.Authorize(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if !strings.HasPrefix(redirect.String(), testRedirectURL+"?") {
+		t.Fatalf("redirected to %s, want %s", redirect, testRedirectURL)
+	}
+	return redirect.Query()
+}
+
+func TestLogin(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	idp.SetIdentity(oidctest.Identity{Subject: "alice", Email: "alice@example.com", EmailVerified: true})
+	req := newLoginRequest(t)
+
+	callback := authorize(t, idp, provider, req)
+	if callback.Get("state") != req.state {
+		t.Fatalf("state = %q, want %q", callback.Get("state"), req.state)
+	}
+
+	ctx := context.Background()
+	rawIDToken, err := provider.Exchange(ctx, callback.Get("code"), req.codeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	claims, err := provider.VerifyIDToken(ctx, rawIDToken, req.nonce)
+	if err != nil {
+		t.Fatalf("VerifyIDToken: %v", err)
+	}
+	if claims.Subject != "alice" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("claims = %+v, want alice's verified identity", claims)
+	}
+}
+
+func TestLoginWithClientSecret(t *testing.T) {
+	idp, _ := newTestProvider(t)
+	idp.ClientSecret = "s3cret/+"
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       idp.URL,
+		ClientID:     testClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  testRedirectURL,
+		HTTPClient:   idp.Client(),
+	})
+	req := newLoginRequest(t)
+
+	callback := authorize(t, idp, provider, req)
+	_, err := provider.Exchange(context.Background(), callback.Get("code"), req.codeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	idp, _ := newTestProvider(t)
+	// discovery is fetched from the configured issuer, so a provider
+	// reporting a different one has to be rejected
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:      strings.Replace(idp.URL, "127.0.0.1", "localhost", 1),
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		HTTPClient:  idp.Client(),
+	})
+	req := newLoginRequest(t)
+
+	_, err := provider.AuthCodeURL(context.Background(), req.state, req.nonce, req.codeVerifier)
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("AuthCodeURL error = %v, want issuer mismatch", err)
+	}
+}
+
+func TestAuthCodeURLUsesPKCE(t *testing.T) {
+	_, provider := newTestProvider(t)
+	req := newLoginRequest(t)
+
+	authURL, err := provider.AuthCodeURL(context.Background(), req.state, req.nonce, req.codeVerifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", q.Get("code_challenge_method"))
+	}
+	if q.Get("code_challenge") != oidc.CodeChallengeS256(req.codeVerifier) {
+		t.Errorf("code_challenge doesn't match the verifier")
+	}
+	if strings.Contains(authURL, req.codeVerifier) {
+		t.Errorf("authorization URL leaks the code verifier")
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	req := newLoginRequest(t)
+	callback := authorize(t, idp, provider, req)
+
+	other := newLoginRequest(t)
+	_, err := provider.Exchange(context.Background(), callback.Get("code"), other.codeVerifier)
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("Exchange error = %v, want invalid_grant", err)
+	}
+}
+
+func TestExchangeRejectsReusedCode(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	req := newLoginRequest(t)
+	callback := authorize(t, idp, provider, req)
+
+	ctx := context.Background()
+	if _, err := provider.Exchange(ctx, callback.Get("code"), req.codeVerifier); err != nil {
+		t.Fatalf("first Exchange: %v", err)
+	}
+	if _, err := provider.Exchange(ctx, callback.Get("code"), req.codeVerifier); err == nil {
+		t.Fatal("second Exchange with the same code succeeded")
+	}
+}
+
+func TestVerifyIDTokenRejectsWrongNonce(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	idp.SetNonce("replayed-nonce")
+	req := newLoginRequest(t)
+	callback := authorize(t, idp, provider, req)
+
+	ctx := context.Background()
+	rawIDToken, err := provider.Exchange(ctx, callback.Get("code"), req.codeVerifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	_, err = provider.VerifyIDToken(ctx, rawIDToken, req.nonce)
+	if err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("VerifyIDToken error = %v, want nonce mismatch", err)
+	}
+}
+
+func TestVerifyIDTokenRejectsUnknownKey(t *testing.T) {
+	idp, provider := newTestProvider(t)
+	req := newLoginRequest(t)
+
+	// signed with a key the provider's JWKS doesn't have
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":   idp.URL,
+		"sub":   "mallory",
+		"aud":   testClientID,
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": req.nonce,
+	})
+	token.Header["kid"] = "forged"
+	rawIDToken, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.VerifyIDToken(context.Background(), rawIDToken, req.nonce)
+	if err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Fatalf("VerifyIDToken error = %v, want unknown key id", err)
+	}
+}
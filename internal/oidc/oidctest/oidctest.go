@@ -0,0 +1,261 @@
+// Package oidctest runs a minimal OpenID Connect identity provider for tests.
+// It serves discovery, JWKS, authorization and token endpoints, and enforces
+// PKCE the way a real provider does.
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const keyID = "oidctest"
+
+// Identity is who signs in at the provider.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type authRequest struct {
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+}
+
+// Server is a mock identity provider. Its URL is the issuer.
+type Server struct {
+	*httptest.Server
+	ClientID string
+	// ClientSecret makes the token endpoint require HTTP basic client
+	// authentication when set
+	ClientSecret string
+
+	mu       sync.Mutex
+	identity Identity
+	// nonce replaces the nonce in ID tokens when set
+	nonce string
+	codes map[string]authRequest
+	key   *ecdsa.PrivateKey
+}
+
+// NewServer starts a provider for a client. Close it when done.
+func NewServer(clientID string) (*Server, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ClientID: clientID,
+		identity: Identity{Subject: "subject-1", Email: "user@example.com", EmailVerified: true},
+		codes:    map[string]authRequest{},
+		key:      key,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.handleDiscovery)
+	mux.HandleFunc("GET /jwks", s.handleJWKS)
+	mux.HandleFunc("GET /authorize", s.handleAuthorize)
+	mux.HandleFunc("POST /token", s.handleToken)
+	s.Server = httptest.NewServer(mux)
+	return s, nil
+}
+
+// SetIdentity changes who signs in from now on.
+func (s *Server) SetIdentity(identity Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identity = identity
+}
+
+// SetNonce makes the provider put nonce in ID tokens instead of the one the
+// client asked for, or stop doing so if it's empty.
+func (s *Server) SetNonce(nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce = nonce
+}
+
+// Authorize follows an authorization URL as a browser would, with the user
+// approving the request, and returns where the provider redirects back to.
+func (s *Server) Authorize(authURL string) (*url.URL, error) {
+	client := s.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("authorization endpoint returned %d", resp.StatusCode)
+	}
+	return url.Parse(resp.Header.Get("Location"))
+}
+
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"jwks_uri":               s.URL + "/jwks",
+	})
+}
+
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": keyID,
+			"use": "sig",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(s.key.PublicKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(s.key.PublicKey.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("response_type") != "code":
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	case q.Get("client_id") != s.ClientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	case q.Get("redirect_uri") == "" || q.Get("state") == "":
+		http.Error(w, "redirect_uri and state are required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authRequest{
+		redirectURI:   q.Get("redirect_uri"),
+		codeChallenge: q.Get("code_challenge"),
+		nonce:         q.Get("nonce"),
+	}
+	s.mu.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	rq := redirect.Query()
+	rq.Set("code", code)
+	rq.Set("state", q.Get("state"))
+	redirect.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request")
+		return
+	}
+	if err := s.authenticateClient(r); err != nil {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type")
+		return
+	}
+
+	s.mu.Lock()
+	req, ok := s.codes[r.PostForm.Get("code")]
+	// codes work once, whether or not the exchange succeeds
+	delete(s.codes, r.PostForm.Get("code"))
+	identity, nonce := s.identity, s.nonce
+	s.mu.Unlock()
+
+	if !ok || req.redirectURI != r.PostForm.Get("redirect_uri") {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != req.codeChallenge {
+		tokenError(w, "invalid_grant")
+		return
+	}
+	if nonce == "" {
+		nonce = req.nonce
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss":            s.URL,
+		"sub":            identity.Subject,
+		"aud":            s.ClientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"nonce":          nonce,
+		"email":          identity.Email,
+		"email_verified": identity.EmailVerified,
+	})
+	token.Header["kid"] = keyID
+	idToken, err := token.SignedString(s.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) authenticateClient(r *http.Request) error {
+	if s.ClientSecret == "" {
+		if r.PostForm.Get("client_id") != s.ClientID {
+			return errors.New("unknown client_id")
+		}
+		return nil
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return errors.New("missing client credentials")
+	}
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != s.ClientID || secret != s.ClientSecret {
+		return errors.New("wrong client credentials")
+	}
+	return nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+	writeJSON(w, http.StatusBadRequest, map[string]string{"error": code})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
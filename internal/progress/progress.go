@@ -0,0 +1,152 @@
+// Package progress tracks the server side progress of video uploads so it
+// can be streamed to clients while the upload request is still running.
+package progress
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type Stage string
+
+const (
+	StageReceiving  Stage = "receiving"
+	StageProbing    Stage = "probing"
+	StageProcessing Stage = "processing"
+	StageStoring    Stage = "storing"
+	StageDone       Stage = "done"
+	StageFailed     Stage = "failed"
+)
+
+// Terminal reports whether the upload has finished, successfully or not.
+func (s Stage) Terminal() bool {
+	return s == StageDone || s == StageFailed
+}
+
+// Update is a snapshot of an upload. Percent is the progress through the
+// current stage, or -1 when it isn't known.
+type Update struct {
+	Stage      Stage     `json:"stage"`
+	Percent    float64   `json:"percent"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	TotalBytes int64     `json:"total_bytes,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// retention is how long the final update of an upload stays around for
+// clients that connect late.
+const retention = time.Minute
+
+// subscriberBuffer is how many updates a slow subscriber can fall behind
+// before older updates are dropped for it.
+const subscriberBuffer = 16
+
+type upload struct {
+	last        Update
+	subscribers map[chan Update]struct{}
+	expiry      *time.Timer
+}
+
+type Tracker struct {
+	mu      sync.Mutex
+	uploads map[uuid.UUID]*upload
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{uploads: map[uuid.UUID]*upload{}}
+}
+
+// Publish records the latest state of a video's upload and sends it to
+// every subscriber. It never blocks: a subscriber that isn't keeping up
+// loses its oldest pending update instead.
+func (t *Tracker) Publish(videoID uuid.UUID, u Update) {
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = time.Now().UTC()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	up := t.get(videoID)
+	up.last = u
+	if up.expiry != nil {
+		up.expiry.Stop()
+		up.expiry = nil
+	}
+	if u.Stage.Terminal() {
+		up.expiry = time.AfterFunc(retention, func() { t.expire(videoID, up) })
+	}
+
+	for ch := range up.subscribers {
+		select {
+		case ch <- u:
+			continue
+		default:
+		}
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- u:
+		default:
+		}
+	}
+}
+
+// Subscribe returns the last update for the video, if there is one, and a
+// channel of the updates that follow. cancel must be called once the caller
+// stops reading.
+func (t *Tracker) Subscribe(videoID uuid.UUID) (last *Update, updates <-chan Update, cancel func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	up := t.get(videoID)
+	if !up.last.UpdatedAt.IsZero() {
+		u := up.last
+		last = &u
+	}
+
+	ch := make(chan Update, subscriberBuffer)
+	up.subscribers[ch] = struct{}{}
+
+	cancel = func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(up.subscribers, ch)
+		if len(up.subscribers) == 0 && up.last.UpdatedAt.IsZero() && t.uploads[videoID] == up {
+			delete(t.uploads, videoID)
+		}
+	}
+	return last, ch, cancel
+}
+
+// get returns the upload for the video, creating it if needed. t.mu must be
+// held.
+func (t *Tracker) get(videoID uuid.UUID) *upload {
+	up, ok := t.uploads[videoID]
+	if !ok {
+		up = &upload{subscribers: map[chan Update]struct{}{}}
+		t.uploads[videoID] = up
+	}
+	return up
+}
+
+// expire forgets a finished upload. While subscribers are still connected
+// the entry is kept, without its final update, so they see the next upload.
+func (t *Tracker) expire(videoID uuid.UUID, up *upload) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.uploads[videoID] != up || !up.last.Stage.Terminal() {
+		return
+	}
+	if len(up.subscribers) > 0 {
+		up.last = Update{}
+		return
+	}
+	delete(t.uploads, videoID)
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Burst requests at once, refilled at Rate requests per second.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: n}
+}
+
+// Window is the time it takes an empty bucket to refill completely.
+func (l Limit) Window() time.Duration {
+	if l.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+// ParseLimit parses limits written as "<count>/<unit>" where unit is s, m or
+// h, for example "10/m".
+func ParseLimit(s string) (Limit, error) {
+	count, unit, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected <count>/<s|m|h>", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid limit count in %q", s)
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("invalid limit unit in %q", s)
+	}
+	return Limit{Rate: float64(n) / per.Seconds(), Burst: n}, nil
+}
+
+// ParseRouteLimits parses overrides written as
+// "POST /api/login=5/m;POST /api/users=3/m".
+func ParseRouteLimits(s string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, limitString, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid route limit %q, expected <pattern>=<limit>", entry)
+		}
+		limit, err := ParseLimit(limitString)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(pattern)] = limit
+	}
+	return limits, nil
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is how long until the next request would be allowed. It's
+	// zero when the request was allowed.
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// Limiter is an in-memory token bucket limiter with one bucket per key.
+type Limiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLimiter() *Limiter {
+	return &Limiter{
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key if one is available.
+func (l *Limiter) Allow(key string, limit Limit) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok || b.limit != limit {
+		b = &bucket{tokens: float64(limit.Burst), last: now, limit: limit}
+		l.buckets[key] = b
+	}
+	b.refill(now)
+
+	result := Result{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((1 - b.tokens) / limit.Rate)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = secondsToDuration((float64(limit.Burst) - b.tokens) / limit.Rate)
+	return result
+}
+
+func (b *bucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.Rate)
+	b.last = now
+}
+
+// sweep drops buckets that have refilled completely, since a new bucket
+// would behave exactly the same. It runs at most once a minute.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
@@ -0,0 +1,283 @@
+// Package webhooks delivers events to user registered endpoints. Events are
+// written to an outbox table when they're published and a background worker
+// sends them, retrying failed deliveries with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+)
+
+const (
+	SignatureHeader = "X-Tubely-Signature"
+	EventHeader     = "X-Tubely-Event"
+	DeliveryHeader  = "X-Tubely-Delivery"
+
+	// MaxAttempts is how many times a delivery is tried before it's marked
+	// failed. With the backoff below the last retry is about a day after the
+	// event.
+	MaxAttempts = 10
+
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+	batchSize   = 50
+	// how much of a failed response body is kept in the delivery log
+	maxErrorBody = 512
+)
+
+// NewSecret returns a random signing secret for a new webhook.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header value for a payload sent at t. Receivers
+// recompute the HMAC-SHA256 of "<t>.<body>" with their secret, compare it to
+// v1 and reject timestamps that are too old to prevent replays.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Backoff returns how long to wait before retrying after the given number of
+// failed attempts.
+func Backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, maxBackoff)
+}
+
+// ErrNonPublicAddress is returned for webhook endpoints that resolve to a
+// loopback, private, link-local or otherwise internal address.
+var ErrNonPublicAddress = errors.New("webhook url must resolve to a public address")
+
+// nonPublicPrefixes are ranges netip doesn't already classify as private or
+// non-global that still aren't reachable on the internet.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// publicAddress reports whether addr is a public unicast address, one
+// webhooks may be sent to. Anything else could reach the server's own network,
+// like the cloud metadata endpoint at 169.254.169.254.
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckHost resolves a webhook endpoint's host and returns
+// ErrNonPublicAddress if any of its addresses isn't public. The dispatcher
+// checks the address it actually connects to again on every delivery, since
+// DNS can change after this.
+func CheckHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("couldn't resolve webhook host: %w", err)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return ErrNonPublicAddress
+		}
+	}
+	return nil
+}
+
+type Dispatcher struct {
+	db     database.Client
+	client *http.Client
+}
+
+// NewDispatcher returns a dispatcher for the webhooks in db. Unless
+// allowNonPublic is set, which is only meant for development, deliveries are
+// refused if the endpoint resolves to a non-public address.
+func NewDispatcher(db database.Client, allowNonPublic bool) *Dispatcher {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+	if !allowNonPublic {
+		// checked on the resolved address as it's dialled, so a host
+		// can't pass a check and then resolve somewhere else
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !publicAddress(addrPort.Addr()) {
+				return ErrNonPublicAddress
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be what's dialled, so the check above wouldn't apply to
+	// the endpoint
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &Dispatcher{
+		db: db,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   10 * time.Second,
+			// a redirect is treated as a failed delivery rather than
+			// followed, so the payload only goes where it was registered
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Enqueue writes a pending delivery for every webhook subscribed to the
+// event. It's meant to be subscribed to the event bus.
+func (d *Dispatcher) Enqueue(ctx context.Context, e events.Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Couldn't encode event", "event_id", e.ID, "error", err)
+		return
+	}
+	// the event has happened even if the request that caused it has since
+	// been cancelled, so the deliveries are recorded regardless
+	err = d.db.EnqueueWebhookDeliveries(context.WithoutCancel(ctx), e.UserID, e.ID, string(e.Type), string(payload))
+	if err != nil {
+		slog.Error("Couldn't enqueue webhook deliveries", "event_id", e.ID, "error", err)
+	}
+}
+
+// Run sends due deliveries until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		d.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	deliveries, err := d.db.GetDueWebhookDeliveries(ctx, time.Now().UTC(), batchSize)
+	if err != nil {
+		slog.Error("Couldn't get due webhook deliveries", "error", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return
+		}
+		attempt := d.deliver(ctx, delivery)
+		if ctx.Err() != nil {
+			// cut short by shutdown, so leave it pending to be retried
+			// rather than count it as a failure
+			return
+		}
+		if err := d.db.RecordWebhookDeliveryAttempt(ctx, attempt); err != nil {
+			slog.Error("Couldn't record webhook delivery", "delivery_id", delivery.ID, "error", err)
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery database.WebhookDelivery) database.WebhookDeliveryAttempt {
+	now := time.Now().UTC()
+	attempt := database.WebhookDeliveryAttempt{
+		ID:          delivery.ID,
+		AttemptedAt: now,
+	}
+
+	fail := func(err error) database.WebhookDeliveryAttempt {
+		message := err.Error()
+		attempt.Error = &message
+		attempt.Status = database.DeliveryStatusFailed
+		if delivery.Attempts+1 < MaxAttempts {
+			next := now.Add(Backoff(delivery.Attempts + 1))
+			attempt.Status = database.DeliveryStatusPending
+			attempt.NextAttemptAt = &next
+		}
+		return attempt
+	}
+
+	webhook, err := d.db.GetWebhook(ctx, delivery.WebhookID)
+	if err != nil {
+		return fail(fmt.Errorf("couldn't get webhook: %w", err))
+	}
+	if webhook.URL == "" {
+		// the webhook was deleted, so there's nothing to retry
+		message := "webhook no longer exists"
+		attempt.Error = &message
+		attempt.Status = database.DeliveryStatusFailed
+		return attempt
+	}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return fail(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Tubely-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, delivery.ID.String())
+	req.Header.Set(SignatureHeader, Sign(webhook.Secret, now, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fail(err)
+	}
+	defer resp.Body.Close()
+
+	attempt.ResponseStatus = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fail(fmt.Errorf("endpoint responded with %s: %s", resp.Status, bytes.TrimSpace(snippet)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+
+	attempt.Status = database.DeliveryStatusSucceeded
+	return attempt
+}
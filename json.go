@@ -2,22 +2,34 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
 )
 
 func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+	// handlers don't pass the request in, but the logging middleware has
+	// already put its ID on the response
+	requestID := w.Header().Get(requestIDHeader)
+	logger := slog.Default()
+	if requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	attrs := []any{"status", code, "message", msg}
 	if err != nil {
-		log.Println(err)
+		attrs = append(attrs, "error", err)
 	}
 	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		logger.Error("Responding with 5XX error", attrs...)
+	} else if err != nil {
+		logger.Info("Responding with error", attrs...)
 	}
 	type errorResponse struct {
-		Error string `json:"error"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id,omitempty"`
 	}
 	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+		Error:     msg,
+		RequestID: requestID,
 	})
 }
 
@@ -25,7 +37,7 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	dat, err := json.Marshal(payload)
 	if err != nil {
-		log.Printf("Error marshalling JSON: %s", err)
+		slog.Error("Error marshalling JSON", "error", err)
 		w.WriteHeader(500)
 		return
 	}
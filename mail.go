@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/google/uuid"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+	passwordResetTTL     = time.Hour
+)
+
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return err
+	}
+	// ParseAddress also accepts "Name <addr>" forms, we only want the bare
+	// address
+	if addr.Address != email {
+		return errors.New("email must be a bare address")
+	}
+	return nil
+}
+
+// createUserToken stores the hash of a new single-use token and returns the
+// token itself, which is only ever sent to the user.
+func (cfg *apiConfig) createUserToken(ctx context.Context, userID uuid.UUID, purpose database.UserTokenPurpose, ttl time.Duration) (string, error) {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = cfg.db.CreateUserToken(ctx, database.CreateUserTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (cfg *apiConfig) sendVerificationEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.createUserToken(ctx, user.ID, database.UserTokenPurposeVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return fmt.Errorf("couldn't create verification token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/app/?verify_email_token=%s", cfg.publicBaseURL, token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your Tubely email address",
+		Body: fmt.Sprintf(
+			"Welcome to Tubely!\n\nConfirm your email address by opening this link:\n\n%s\n\nThe link expires in %s.\n",
+			link, emailVerificationTTL,
+		),
+	})
+}
+
+func (cfg *apiConfig) sendPasswordResetEmail(ctx context.Context, user database.User) error {
+	token, err := cfg.createUserToken(ctx, user.ID, database.UserTokenPurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return fmt.Errorf("couldn't create password reset token: %w", err)
+	}
+
+	link := fmt.Sprintf("%s/app/?password_reset_token=%s", cfg.publicBaseURL, token)
+	return cfg.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your Tubely password",
+		Body: fmt.Sprintf(
+			"Someone asked to reset the password for this Tubely account.\n\nChoose a new password here:\n\n%s\n\nThe link expires in %s. If this wasn't you, you can ignore this email.\n",
+			link, passwordResetTTL,
+		),
+	})
+}
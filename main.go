@@ -2,13 +2,26 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"sync"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/config"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/mailer"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/oidc"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/progress"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/tracing"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/webhooks"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -16,7 +29,7 @@ import (
 
 type apiConfig struct {
 	db               database.Client
-	jwtSecret        string
+	jwtKeys          *auth.KeySet
 	platform         string
 	filepathRoot     string
 	assetsRoot       string
@@ -25,113 +38,320 @@ type apiConfig struct {
 	s3CfDistribution string
 	port             string
 	s3Client         *s3.Client
+	oidcProvider     *oidc.Provider
+	mailer           mailer.Mailer
+	publicBaseURL    string
+	rateLimiter      *rateLimiter
+	events           *events.Bus
+	progress         *progress.Tracker
+	// videoVersionRetention is how many versions of a video are kept in
+	// storage, 0 keeps them all
+	videoVersionRetention int
+	defaultQuota          quotaLimits
+	adminAPIKey           string
+	minTempFreeBytes      uint64
+	readiness             *readinessCache
+	// shutdown is closed once the server starts shutting down, to end
+	// long-lived responses
+	shutdown chan struct{}
+	// background counts work handlers started to finish after responding
+	background *sync.WaitGroup
 }
 
 func main() {
 	godotenv.Load(".env")
 
-	pathToDB := os.Getenv("DB_PATH")
-	if pathToDB == "" {
-		log.Fatal("DB_URL must be set")
-	}
+	os.Exit(runCommand(os.Args[1:]))
+}
 
-	db, err := database.NewClient(pathToDB)
+// newAPIConfig opens the database and storage clients and sets up everything
+// else the server and the commands share.
+func newAPIConfig(conf config.Config) (*apiConfig, error) {
+	db, err := database.NewClient(conf.DBPath)
 	if err != nil {
-		log.Fatalf("Couldn't connect to database: %v", err)
+		return nil, fmt.Errorf("couldn't connect to database: %w", err)
 	}
+	db.ObserveQueries(metrics.ObserveDBQuery)
 
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret == "" {
-		log.Fatal("JWT_SECRET environment variable is not set")
+	var jwtKeys *auth.KeySet
+	if conf.JWT.KeysDir != "" {
+		jwtKeys, err = auth.LoadKeySet(conf.JWT.KeysDir, conf.JWT.SigningKeyID, conf.JWT.Secret)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("couldn't load JWT keys: %w", err)
+		}
+	} else {
+		jwtKeys = auth.NewHMACKeySet(conf.JWT.Secret)
 	}
 
-	platform := os.Getenv("PLATFORM")
-	if platform == "" {
-		log.Fatal("PLATFORM environment variable is not set")
+	s3Client, err := newS3Client(conf)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
+	cfg := &apiConfig{
+		db:                    db,
+		jwtKeys:               jwtKeys,
+		platform:              conf.Platform,
+		filepathRoot:          conf.FilepathRoot,
+		assetsRoot:            conf.AssetsRoot,
+		s3Bucket:              conf.S3.Bucket,
+		s3Region:              conf.S3.Region,
+		s3CfDistribution:      conf.S3.CFDistribution,
+		port:                  conf.Port,
+		s3Client:              s3Client,
+		publicBaseURL:         conf.PublicBaseURL,
+		events:                events.NewBus(),
+		progress:              progress.NewTracker(),
+		videoVersionRetention: conf.VideoVersionRetention,
+		defaultQuota: quotaLimits{
+			MaxBytes:  int64(conf.Quota.MaxBytes),
+			MaxVideos: conf.Quota.MaxVideos,
+		},
+		adminAPIKey:      conf.AdminAPIKey,
+		minTempFreeBytes: uint64(conf.MinTempFree),
+		readiness:        &readinessCache{},
+		shutdown:         make(chan struct{}),
+		background:       &sync.WaitGroup{},
 	}
 
-	assetsRoot := os.Getenv("ASSETS_ROOT")
-	if assetsRoot == "" {
-		log.Fatal("ASSETS_ROOT environment variable is not set")
+	switch conf.Mail.Mailer {
+	case "smtp":
+		cfg.mailer = mailer.SMTPMailer{
+			Host:     conf.Mail.SMTPHost,
+			Port:     conf.Mail.SMTPPort,
+			Username: conf.Mail.SMTPUsername,
+			Password: conf.Mail.SMTPPassword,
+			From:     conf.Mail.From,
+		}
+	case "log":
+		cfg.mailer = &mailer.LogMailer{
+			Path: conf.Mail.LogPath,
+			From: conf.Mail.From,
+		}
 	}
 
-	s3Bucket := os.Getenv("S3_BUCKET")
-	if s3Bucket == "" {
-		log.Fatal("S3_BUCKET environment variable is not set")
+	// both were checked by Validate
+	defaultRateLimit, _ := ratelimit.ParseLimit(conf.RateLimit.Default)
+	routeLimits, _ := ratelimit.ParseRouteLimits(conf.RateLimit.Routes)
+	for pattern, limit := range defaultRouteLimits {
+		if _, ok := routeLimits[pattern]; !ok {
+			routeLimits[pattern] = limit
+		}
 	}
-
-	s3Region := os.Getenv("S3_REGION")
-	if s3Region == "" {
-		log.Fatal("S3_REGION environment variable is not set")
+	cfg.rateLimiter = &rateLimiter{
+		limiter:           ratelimit.NewLimiter(),
+		defaultLimit:      defaultRateLimit,
+		routeLimits:       routeLimits,
+		trustForwardedFor: conf.RateLimit.TrustXForwardedFor,
 	}
 
-	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
-	if s3CfDistribution == "" {
-		log.Fatal("S3_CF_DISTRO environment variable is not set")
+	if conf.OIDC.Issuer != "" {
+		cfg.oidcProvider = oidc.NewProvider(oidc.Config{
+			Issuer:       conf.OIDC.Issuer,
+			ClientID:     conf.OIDC.ClientID,
+			ClientSecret: conf.OIDC.ClientSecret,
+			RedirectURL:  conf.OIDC.RedirectURL,
+		})
 	}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		log.Fatal("PORT environment variable is not set")
+	err = cfg.ensureAssetsDir()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("couldn't create assets directory: %w", err)
 	}
+	return cfg, nil
+}
 
-	s3Cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+func newS3Client(conf config.Config) (*s3.Client, error) {
+	s3Cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(conf.S3.Region))
 	if err != nil {
-		log.Fatal("Failed to get AWS S3 Client")
+		return nil, fmt.Errorf("failed to get AWS S3 client: %w", err)
 	}
+	return s3.NewFromConfig(s3Cfg, withS3Metrics, withS3Tracing), nil
+}
 
-	s3Client := s3.NewFromConfig(s3Cfg)
-
-	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         s3Client,
+// runServe runs the HTTP server and background jobs until ctx is cancelled,
+// then shuts them down gracefully.
+func runServe(ctx context.Context, conf config.Config) error {
+	shutdownTracing, err := tracing.Setup(context.Background())
+	if err != nil {
+		return fmt.Errorf("couldn't set up tracing: %w", err)
 	}
 
-	err = cfg.ensureAssetsDir()
+	cfg, err := newAPIConfig(conf)
 	if err != nil {
-		log.Fatalf("Couldn't create assets directory: %v", err)
+		return err
 	}
 
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
+	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(conf.FilepathRoot)))
 	mux.Handle("/app/", appHandler)
 
-	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
+	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(conf.AssetsRoot)))
 	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
 
+	mux.HandleFunc("GET /healthz", cfg.handlerHealthz)
+	mux.HandleFunc("GET /readyz", cfg.handlerReadyz)
+
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.handlerJWKS)
+
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
+	mux.HandleFunc("POST /api/login/mfa", cfg.handlerLoginMFA)
+	if cfg.oidcProvider != nil {
+		mux.HandleFunc("GET /api/oidc/login", cfg.handlerOIDCLogin)
+		mux.HandleFunc("GET /api/oidc/callback", cfg.handlerOIDCCallback)
+		mux.HandleFunc("POST /api/oidc/exchange", cfg.handlerOIDCExchange)
+	}
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("POST /api/users/verify", cfg.handlerUsersVerifyEmail)
+	mux.HandleFunc("POST /api/users/verify/resend", cfg.handlerUsersResendVerification)
+	mux.HandleFunc("POST /api/users/deletion/confirm", cfg.handlerAccountDeletionConfirm)
+	mux.HandleFunc("POST /api/users/deletion/cancel", cfg.handlerAccountDeletionCancel)
+	mux.HandleFunc("POST /api/password/forgot", cfg.handlerPasswordForgot)
+	mux.HandleFunc("POST /api/password/reset", cfg.handlerPasswordReset)
+
+	mux.HandleFunc("POST /api/mfa/totp", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/mfa/totp/verify", cfg.handlerTOTPVerify)
+	mux.HandleFunc("DELETE /api/mfa/totp", cfg.handlerTOTPDisable)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/stream", cfg.handlerVideoStream)
+	mux.HandleFunc("GET /api/videos/{videoID}/progress", cfg.handlerVideoProgress)
+	mux.HandleFunc("POST /api/videos/{videoID}/media_token", cfg.handlerVideoMediaToken)
+	mux.HandleFunc("GET /api/videos/{videoID}/versions", cfg.handlerVideoVersionsRetrieve)
+	mux.HandleFunc("POST /api/videos/{videoID}/versions/{versionID}/rollback", cfg.handlerVideoVersionRollback)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
+	mux.HandleFunc("PUT /api/videos/{videoID}/visibility", cfg.handlerVideoVisibilityUpdate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/schedule", cfg.handlerVideoScheduleUpdate)
+	mux.HandleFunc("GET /api/public/videos", cfg.handlerPublicVideosRetrieve)
+
+	mux.HandleFunc("POST /api/videos/{videoID}/shares", cfg.handlerShareLinkCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/shares", cfg.handlerShareLinksRetrieve)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/shares/{shareID}", cfg.handlerShareLinkRevoke)
+	mux.HandleFunc("GET /api/shares/{token}", cfg.handlerShareLinkResolve)
+
+	mux.HandleFunc("POST /api/webhooks", cfg.handlerWebhookCreate)
+	mux.HandleFunc("GET /api/webhooks", cfg.handlerWebhooksRetrieve)
+	mux.HandleFunc("DELETE /api/webhooks/{webhookID}", cfg.handlerWebhookDelete)
+	mux.HandleFunc("GET /api/webhooks/{webhookID}/deliveries", cfg.handlerWebhookDeliveriesRetrieve)
+
+	mux.HandleFunc("DELETE /api/me", cfg.handlerAccountDelete)
+	mux.HandleFunc("GET /api/me/usage", cfg.handlerUsageRetrieve)
+	mux.HandleFunc("POST /api/me/exports", cfg.handlerExportCreate)
+	mux.HandleFunc("GET /api/me/exports/{exportID}", cfg.handlerExportGet)
 
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
+	if cfg.adminAPIKey != "" {
+		mux.HandleFunc("PUT /admin/users/{userID}/quota", cfg.handlerAdminQuotaUpdate)
+	}
+
+	// /metrics and the detailed readiness report are only served on
+	// METRICS_ADDR, never on the public port, and not at all unless it's set
+	var servers []*http.Server
+	if conf.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		metricsMux.HandleFunc("GET /readyz", cfg.handlerReadyzReport)
+		servers = append(servers, &http.Server{
+			Addr:    conf.MetricsAddr,
+			Handler: metricsMux,
+		})
+	}
 
+	var requests sync.WaitGroup
+	handler := metricsMiddleware(mux, tracingMiddleware(mux, cfg.loggingMiddleware(mux, cfg.rateLimitMiddleware(mux, cfg.accountStatusMiddleware(mux)))))
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:    ":" + conf.Port,
+		Handler: trackRequests(&requests, handler),
+	}
+	// progress streams never finish on their own, so end them rather than
+	// have the shutdown wait its whole timeout on them
+	srv.RegisterOnShutdown(func() { close(cfg.shutdown) })
+	servers = append(servers, srv)
+
+	cleanStaleTempFiles()
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var jobs sync.WaitGroup
+	cfg.events.Subscribe(func(ctx context.Context, e events.Event) {
+		slog.InfoContext(ctx, "Event published", "event_id", e.ID, "type", e.Type, "user_id", e.UserID, "video_id", e.VideoID)
+	})
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		cfg.runScheduler(ctx, schedulerInterval)
+	}()
+
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		cfg.runExportWorker(ctx, exportWorkerInterval)
+	}()
+
+	dispatcher := webhooks.NewDispatcher(cfg.db, cfg.platform == "dev")
+	cfg.events.Subscribe(dispatcher.Enqueue)
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		dispatcher.Run(ctx, webhookDispatchInterval)
+	}()
+
+	serveErrs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func() {
+			if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				serveErrs <- err
+			}
+		}()
+	}
+	if conf.MetricsAddr != "" {
+		slog.Info("Serving metrics", "addr", conf.MetricsAddr)
 	}
+	slog.Info("Serving", "url", "http://localhost:"+conf.Port+"/app/")
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	var serveErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down, draining in-flight requests", "timeout", conf.ShutdownTimeout)
+	case serveErr = <-serveErrs:
+		slog.Error("Server failed, shutting down", "error", serveErr)
+		stop()
+	}
+
+	// uploads are processed within their request, so draining the servers
+	// waits for them too. Whatever is still running at the deadline has its
+	// connection closed, which cancels its context and kills any ffmpeg run.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Timed out draining requests, closing connections", "addr", s.Addr, "error", err)
+			s.Close()
+		}
+	}
+	if !waitTimeout(&requests, cancelledRequestGrace) {
+		slog.Warn("Requests still running after closing their connections")
+	}
+	jobs.Wait()
+	cfg.background.Wait()
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Couldn't flush traces", "error", err)
+	}
+	if err := cfg.db.Close(); err != nil {
+		slog.Error("Couldn't close database", "error", err)
+	}
+	slog.Info("Shut down")
+	return serveErr
 }
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+)
+
+// metricsMiddleware times every request, labelled with the ServeMux pattern
+// that matched it so paths with IDs in them share one series.
+func metricsMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.ObserveHTTPRequest(pattern, normalizeMethod(r.Method), status, time.Since(start))
+	})
+}
+
+// normalizeMethod returns the request method if it's a standard one and
+// "other" if not. Clients can send any method, so labelling or naming things
+// with it unchecked would let them create as many series as they like.
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// withS3Metrics times each request the S3 client sends. It sits in the
+// deserialize step, which presigning never reaches, so presigned URLs are
+// only counted by generatePresignedURL.
+func withS3Metrics(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("TubelyMetrics",
+			func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+				start := time.Now()
+				out, metadata, err := next.HandleDeserialize(ctx, in)
+				metrics.ObserveS3Operation(awsmiddleware.GetOperationName(ctx), time.Since(start), err)
+				return out, metadata, err
+			}), middleware.Before)
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// quotaLimits are the limits that apply to a user. 0 means unlimited.
+type quotaLimits struct {
+	MaxBytes  int64 `json:"max_bytes"`
+	MaxVideos int   `json:"max_videos"`
+}
+
+// userQuota applies a user's overrides to the default limits.
+func (cfg *apiConfig) userQuota(ctx context.Context, userID uuid.UUID) (quotaLimits, error) {
+	limits := cfg.defaultQuota
+	override, err := cfg.db.GetUserQuota(ctx, userID)
+	if err != nil {
+		return quotaLimits{}, err
+	}
+	if override.MaxBytes != nil {
+		limits.MaxBytes = *override.MaxBytes
+	}
+	if override.MaxVideos != nil {
+		limits.MaxVideos = *override.MaxVideos
+	}
+	return limits, nil
+}
+
+// checkStorageQuota reports whether the user can store size more bytes
+// without going over their quota. Concurrent uploads are each checked against
+// the usage before either lands, so the limit is soft by up to one upload.
+func (cfg *apiConfig) checkStorageQuota(ctx context.Context, userID uuid.UUID, size int64) (bool, error) {
+	limits, err := cfg.userQuota(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if limits.MaxBytes == 0 {
+		return true, nil
+	}
+	usage, err := cfg.db.GetUserUsage(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return usage.BytesUsed+size <= limits.MaxBytes, nil
+}
+
+func (cfg *apiConfig) checkVideoQuota(ctx context.Context, userID uuid.UUID) (bool, error) {
+	limits, err := cfg.userQuota(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if limits.MaxVideos == 0 {
+		return true, nil
+	}
+	usage, err := cfg.db.GetUserUsage(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return usage.VideoCount < limits.MaxVideos, nil
+}
+
+func (cfg *apiConfig) handlerUsageRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		BytesUsed  int64       `json:"bytes_used"`
+		VideoCount int         `json:"video_count"`
+		Quota      quotaLimits `json:"quota"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtKeys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		return
+	}
+
+	usage, err := cfg.db.GetUserUsage(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get usage", err)
+		return
+	}
+	limits, err := cfg.userQuota(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't get quota", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		BytesUsed:  usage.BytesUsed,
+		VideoCount: usage.VideoCount,
+		Quota:      limits,
+	})
+}
+
+// isAdminAPIKey reports whether apiKey is the configured admin API key. No
+// key is valid when none is configured.
+func (cfg *apiConfig) isAdminAPIKey(apiKey string) bool {
+	if cfg.adminAPIKey == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminAPIKey)) == 1
+}
+
+// handlerAdminQuotaUpdate sets a user's quota overrides. It's only
+// registered when ADMIN_API_KEY is set, and needs that key as
+// "Authorization: ApiKey <key>".
+func (cfg *apiConfig) handlerAdminQuotaUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MaxBytes  *int64 `json:"max_bytes"`
+		MaxVideos *int   `json:"max_videos"`
+	}
+
+	apiKey, err := auth.GetAPIKey(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "Couldn't find API key", err)
+		return
+	}
+	if !cfg.isAdminAPIKey(apiKey) {
+		respondWithError(w, http.StatusUnauthorized, "Invalid API key", nil)
+		return
+	}
+
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	user, err := cfg.db.GetUser(r.Context(), userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, "Couldn't get user", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if (params.MaxBytes != nil && *params.MaxBytes < 0) || (params.MaxVideos != nil && *params.MaxVideos < 0) {
+		respondWithError(w, http.StatusBadRequest, "Quotas can't be negative", nil)
+		return
+	}
+
+	quota := database.UserQuota{
+		UserID:    userID,
+		MaxBytes:  params.MaxBytes,
+		MaxVideos: params.MaxVideos,
+	}
+	err = cfg.db.SetUserQuota(r.Context(), quota)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Couldn't set quota", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, quota)
+}
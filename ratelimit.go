@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/ratelimit"
+)
+
+// defaultRouteLimits protect the endpoints that hash passwords, send email or
+// accept guessable secrets. Every other route gets the default limit.
+var defaultRouteLimits = map[string]ratelimit.Limit{
+	"POST /api/login":                 ratelimit.PerMinute(10),
+	"POST /api/login/mfa":             ratelimit.PerMinute(10),
+	"POST /api/users":                 ratelimit.PerMinute(5),
+	"POST /api/users/verify":          ratelimit.PerMinute(10),
+	"POST /api/password/forgot":       ratelimit.PerMinute(5),
+	"POST /api/password/reset":        ratelimit.PerMinute(10),
+	"POST /api/mfa/totp/verify":       ratelimit.PerMinute(10),
+	"DELETE /api/mfa/totp":            ratelimit.PerMinute(10),
+	"GET /api/oidc/callback":          ratelimit.PerMinute(20),
+	"POST /api/users/verify/resend":   ratelimit.PerMinute(3),
+	"GET /api/shares/{token}":         ratelimit.PerMinute(30),
+	"POST /api/me/exports":            ratelimit.PerMinute(2),
+	"DELETE /api/me":                  ratelimit.PerMinute(5),
+	"POST /api/users/deletion/cancel": ratelimit.PerMinute(10),
+}
+
+type rateLimiter struct {
+	limiter      *ratelimit.Limiter
+	defaultLimit ratelimit.Limit
+	routeLimits  map[string]ratelimit.Limit
+	// trustForwardedFor makes the client IP come from the last
+	// X-Forwarded-For entry, which is only safe behind a proxy that sets it
+	trustForwardedFor bool
+}
+
+// rateLimitMiddleware limits requests per route pattern. Requests are keyed
+// by the admin API key if it's sent, then by user for valid access tokens,
+// and by client IP otherwise.
+func (cfg *apiConfig) rateLimitMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		limit, ok := cfg.rateLimiter.routeLimits[pattern]
+		if !ok {
+			limit = cfg.rateLimiter.defaultLimit
+		}
+
+		key := pattern + "|" + cfg.rateLimitKey(r)
+		result := cfg.rateLimiter.limiter.Allow(key, limit)
+
+		w.Header().Set("RateLimit-Limit", fmt.Sprint(result.Limit))
+		w.Header().Set("RateLimit-Remaining", fmt.Sprint(result.Remaining))
+		w.Header().Set("RateLimit-Reset", fmt.Sprint(ceilSeconds(result.Reset)))
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, ceilSeconds(limit.Window())))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", fmt.Sprint(ceilSeconds(result.RetryAfter)))
+			respondWithError(w, http.StatusTooManyRequests, "Too many requests, slow down", nil)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitKey is who a request counts against. Only the real admin API key
+// gets its own bucket, or sending a made-up key with every request would get
+// around the per-IP limits.
+func (cfg *apiConfig) rateLimitKey(r *http.Request) string {
+	if apiKey, err := auth.GetAPIKey(r.Header); err == nil && cfg.isAdminAPIKey(apiKey) {
+		return "apikey:admin"
+	}
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		if userID, err := auth.ValidateJWT(token, cfg.jwtKeys); err == nil {
+			return "user:" + userID.String()
+		}
+	}
+	return "ip:" + cfg.clientIP(r)
+}
+
+func (cfg *apiConfig) clientIP(r *http.Request) string {
+	if cfg.rateLimiter.trustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/events"
+)
+
+const schedulerInterval = 30 * time.Second
+
+// runScheduler applies due publish and unpublish times and deletes accounts
+// whose grace period is over until ctx is cancelled.
+func (cfg *apiConfig) runScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+		cfg.applyVideoSchedules(ctx, now)
+		cfg.deleteDueAccounts(ctx, now)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (cfg *apiConfig) applyVideoSchedules(ctx context.Context, now time.Time) {
+	videos, err := cfg.db.GetVideosDueForScheduleChange(ctx, now)
+	if err != nil {
+		slog.Error("Couldn't get scheduled videos", "error", err)
+		return
+	}
+
+	for _, video := range videos {
+		// publish before unpublish so a window that passed entirely while
+		// the server was down ends up private
+		if video.PublishAt != nil && !now.Before(*video.PublishAt) {
+			ok, err := cfg.db.PublishScheduledVideo(ctx, video.ID, now)
+			if err != nil {
+				slog.Error("Couldn't publish scheduled video", "video_id", video.ID, "error", err)
+				continue
+			}
+			if ok {
+				cfg.events.Publish(ctx, events.Event{
+					Type:    events.VideoPublished,
+					UserID:  video.UserID,
+					VideoID: video.ID,
+				})
+			}
+		}
+
+		if video.UnpublishAt != nil && !now.Before(*video.UnpublishAt) {
+			ok, err := cfg.db.UnpublishScheduledVideo(ctx, video.ID, now)
+			if err != nil {
+				slog.Error("Couldn't unpublish scheduled video", "video_id", video.ID, "error", err)
+				continue
+			}
+			if ok {
+				cfg.events.Publish(ctx, events.Event{
+					Type:    events.VideoUnpublished,
+					UserID:  video.UserID,
+					VideoID: video.ID,
+				})
+			}
+		}
+	}
+}
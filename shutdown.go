@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// staleTempPatterns match the temp copies of uploads, the files ffmpeg
+// writes next to them, and exports being built.
+var staleTempPatterns = []string{"tubely-upload*", "tubely-export*"}
+
+// staleTempFileAge is how old a temp file has to be before it's treated as
+// left behind by a crash. Younger ones may belong to another instance
+// sharing the temp dir.
+const staleTempFileAge = time.Hour
+
+// cleanStaleTempFiles removes temp files that were never cleaned up, e.g.
+// because the server was killed mid-upload or while building an export.
+func cleanStaleTempFiles() {
+	for _, pattern := range staleTempPatterns {
+		paths, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err != nil {
+			slog.Error("Couldn't list stale temp files", "pattern", pattern, "error", err)
+			continue
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || time.Since(info.ModTime()) < staleTempFileAge {
+				continue
+			}
+			if err := os.Remove(path); err != nil {
+				slog.Error("Couldn't remove stale temp file", "path", path, "error", err)
+				continue
+			}
+			slog.Info("Removed stale temp file", "path", path)
+		}
+	}
+}
+
+// cancelledRequestGrace is how long to wait, after closing connections at
+// the shutdown deadline, for the cancelled handlers to clean up after
+// themselves.
+const cancelledRequestGrace = 5 * time.Second
+
+// trackRequests counts in-flight requests in wg. http.Server.Close doesn't
+// wait for handlers to return, so this is what lets main wait for them.
+func trackRequests(wg *sync.WaitGroup, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wg.Add(1)
+		defer wg.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// goBackground runs fn after the handler that starts it has responded. The
+// server waits for it before closing the database on shutdown.
+func (cfg *apiConfig) goBackground(fn func()) {
+	cfg.background.Add(1)
+	go func() {
+		defer cfg.background.Done()
+		fn()
+	}()
+}
+
+// waitTimeout waits for wg, giving up after timeout. It reports whether
+// everything finished.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
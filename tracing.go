@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/bootdotdev/learn-file-storage-s3-golang-starter")
+
+// tracingMiddleware starts a server span for every request, continuing the
+// caller's trace if it sent a traceparent header. Spans are named after the
+// matched ServeMux pattern.
+func tracingMiddleware(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		_, pattern := mux.Handler(r)
+		name := pattern
+		if name == "" {
+			name = normalizeMethod(r.Method) + " unmatched"
+		}
+		attrs := []attribute.KeyValue{
+			attribute.String("http.request.method", normalizeMethod(r.Method)),
+			attribute.String("url.path", r.URL.Path),
+		}
+		if pattern != "" {
+			attrs = append(attrs, attribute.String("http.route", pattern))
+		}
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// withS3Tracing adds a client span for every request the S3 client sends,
+// in the same place as withS3Metrics so each retry gets its own span.
+func withS3Tracing(o *s3.Options) {
+	o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+		return stack.Deserialize.Add(middleware.DeserializeMiddlewareFunc("TubelyTracing",
+			func(ctx context.Context, in middleware.DeserializeInput, next middleware.DeserializeHandler) (middleware.DeserializeOutput, middleware.Metadata, error) {
+				operation := awsmiddleware.GetOperationName(ctx)
+				ctx, span := tracer.Start(ctx, "S3."+operation,
+					trace.WithSpanKind(trace.SpanKindClient),
+					trace.WithAttributes(
+						attribute.String("rpc.system", "aws-api"),
+						attribute.String("rpc.service", "S3"),
+						attribute.String("rpc.method", operation),
+					),
+				)
+				defer span.End()
+
+				out, metadata, err := next.HandleDeserialize(ctx, in)
+				if err != nil {
+					span.RecordError(err)
+					span.SetStatus(codes.Error, err.Error())
+				}
+				return out, metadata, err
+			}), middleware.Before)
+	})
+}
+
+// startMediaCommand traces and times a run of ffprobe or ffmpeg. Call the
+// returned func with the command's result once it has exited.
+func startMediaCommand(ctx context.Context, cmd *exec.Cmd) func(error) {
+	command := cmd.Args[0]
+	_, span := tracer.Start(ctx, "exec "+command,
+		trace.WithAttributes(attribute.String("process.executable.name", command)),
+	)
+	start := time.Now()
+	return func(err error) {
+		metrics.ObserveMediaCommand(command, time.Since(start), err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, fmt.Sprintf("%s failed", command))
+		}
+		span.End()
+	}
+}